@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetAbsence      = ql.MustCompile(`SELECT id(), Person, Kind, Start, End, Substitute FROM Absence WHERE id() == $1;`)
+	qGetAllAbsences  = ql.MustCompile(`SELECT id(), Person, Kind, Start, End, Substitute FROM Absence WHERE End >= $1 ORDER BY Start ASC;`)
+	qCurrentAbsences = ql.MustCompile(`SELECT id(), Person, Kind, Start, End, Substitute FROM Absence WHERE Start <= $1 && End >= $1 ORDER BY Start ASC;`)
+	qInsertAbsence   = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Absence VALUES($1, $2, $3, $4, $5); COMMIT;`)
+	qUpdateAbsence   = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Absence SET Person = $1, Kind = $2, Start = $3, End = $4, Substitute = $5 WHERE id() == $6; COMMIT;`)
+	qDeleteAbsence   = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Absence WHERE id() == $1; COMMIT;`)
+	qDeleteAbsences  = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Absence WHERE Person == $1; COMMIT;`)
+	qClearSubstitute = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Absence SET Substitute = 0 WHERE Substitute == $1; COMMIT;`)
+	qPersonNames     = ql.MustCompile(`SELECT id(), Name FROM Person;`)
+)
+
+// Kinds of absences.
+const (
+	AbsenceVacation = "vacation"
+	AbsenceLeave    = "leave"
+	AbsenceCourse   = "course"
+	AbsenceRemote   = "remote" // working from home
+)
+
+// absenceKinds are the known kinds of absences, with their Norwegian names.
+var absenceKinds = map[string]string{
+	AbsenceVacation: "ferie",
+	AbsenceLeave:    "permisjon",
+	AbsenceCourse:   "kurs",
+	AbsenceRemote:   "hjemmekontor",
+}
+
+// dateLayout is the layout of the Start and End dates of absences. Dates in
+// this layout sort lexically.
+const dateLayout = "2006-01-02"
+
+// absence is a period, in whole days, where a person is not at work.
+type absence struct {
+	ID         int64
+	Person     int64
+	Kind       string
+	Start      string // first day, as 2006-01-02
+	End        string // last day, as 2006-01-02
+	Substitute int64  // the person to contact instead; 0 if none
+}
+
+// today returns the current date in the layout of absences.
+func today() string {
+	return time.Now().Format(dateLayout)
+}
+
+// validate checks the absence, and that the persons exist. On failure it
+// returns the HTTP status code to respond with.
+func (a *absence) validate(ctx *ql.TCtx, function string) (int, error) {
+	if _, ok := absenceKinds[a.Kind]; !ok {
+		return http.StatusBadRequest, fmt.Errorf("unknown kind of absence: %q", a.Kind)
+	}
+	if a.End == "" {
+		a.End = a.Start
+	}
+	for _, d := range []string{a.Start, a.End} {
+		if _, err := time.Parse(dateLayout, d); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("dates must be given as YYYY-MM-DD, got %q", d)
+		}
+	}
+	if a.End < a.Start {
+		return http.StatusBadRequest, errors.New("absence cannot end before it starts")
+	}
+	if a.Person == 0 {
+		return http.StatusBadRequest, errors.New("absence must have a person")
+	}
+	if a.Substitute == a.Person {
+		return http.StatusBadRequest, errors.New("person cannot be their own substitute")
+	}
+
+	ids := []int64{a.Person}
+	if a.Substitute != 0 {
+		ids = append(ids, a.Substitute)
+	}
+	for _, id := range ids {
+		p, err := fetchPerson(ctx, id)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if p == nil {
+			return http.StatusNotFound, errors.New("person does not exist")
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// absenceRows returns the absences from running q with the given arguments.
+func absenceRows(ctx *ql.TCtx, q ql.List, args ...interface{}) ([]*absence, error) {
+	rs, _, err := db.Execute(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*absence
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		a := &absence{}
+		if err := ql.Unmarshal(a, data); err != nil {
+			return false, err
+		}
+		res = append(res, a)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setPersonAbsences fills in the current absences of the given persons.
+func setPersonAbsences(ctx *ql.TCtx, ps ...*person) error {
+	as, err := absenceRows(ctx, qCurrentAbsences, today())
+	if err != nil {
+		return err
+	}
+	byPerson := make(map[int64]*absence)
+	for _, a := range as {
+		if byPerson[a.Person] == nil {
+			byPerson[a.Person] = a
+		}
+	}
+	for _, p := range ps {
+		p.Absence = byPerson[p.ID]
+	}
+	return nil
+}
+
+// fetchAbsence returns the absence with the ID given in the id parameter, or
+// the status code and error to respond with.
+func fetchAbsence(ctx *ql.TCtx, u *url.URL, function string) (*absence, int, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("absence ID must be an integer")
+	}
+	as, err := absenceRows(ctx, qGetAbsence, int64(id))
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	if len(as) == 0 {
+		return nil, http.StatusNotFound, errors.New("absence not found")
+	}
+	return as[0], http.StatusOK, nil
+}
+
+// filterAbsences returns the absences which are not over before the from
+// parameter (default today), of the person given in the person parameter or
+// the members of the department given in the dept parameter.
+func filterAbsences(ctx *ql.TCtx, u *url.URL, function string) ([]*absence, int, error) {
+	from := u.Query().Get("from")
+	if from == "" {
+		from = today()
+	} else if _, err := time.Parse(dateLayout, from); err != nil {
+		return nil, http.StatusBadRequest, errors.New("from parameter must be a date, as YYYY-MM-DD")
+	}
+
+	as, err := absenceRows(ctx, qGetAllAbsences, from)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	var ids map[int64]bool
+	if personStr := u.Query().Get("person"); personStr != "" {
+		id, err := strconv.Atoi(personStr)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("person parameter must be an integer")
+		}
+		ids = map[int64]bool{int64(id): true}
+	} else if deptStr := u.Query().Get("dept"); deptStr != "" {
+		dept, err := strconv.Atoi(deptStr)
+		if err != nil {
+			return nil, http.StatusBadRequest, errors.New("dept parameter must be an integer")
+		}
+		if ids, err = deptMembers(ctx, int64(dept)); err != nil {
+			log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+			return nil, http.StatusInternalServerError, errors.New("database query failed")
+		}
+	}
+
+	res := []*absence{}
+	for _, a := range as {
+		if ids == nil || ids[a.Person] {
+			res = append(res, a)
+		}
+	}
+	return res, http.StatusOK, nil
+}
+
+// GET /absence
+//
+// getAbsences returns current and future absences, filtered as described by
+// filterAbsences.
+func getAbsences(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*absence, error) {
+	as, status, err := filterAbsences(readCtx, u, "getAbsences")
+	if err != nil {
+		return status, nil, nil, err
+	}
+	return http.StatusOK, nil, as, nil
+}
+
+// POST /absence
+func createAbsence(u *url.URL, h http.Header, a *absence) (int, http.Header, *absence, error) {
+	ctx := ql.NewRWCtx()
+	if status, err := a.validate(ctx, "createAbsence"); err != nil {
+		return status, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qInsertAbsence, a.Person, a.Kind, a.Start, a.End, a.Substitute); err != nil {
+		log.Error("failed insert into table Absence", log.Ctx{"function": "createAbsence", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+	}
+	a.ID = ctx.LastInsertID
+
+	log.Info("absence created", log.Ctx{"ID": a.ID, "Person": a.Person, "Kind": a.Kind, "Start": a.Start, "End": a.End})
+
+	return http.StatusCreated, http.Header{
+		"Content-Location": {fmt.Sprintf(
+			"%s://%s/api/absence/%d",
+			u.Scheme,
+			u.Host,
+			a.ID,
+		)},
+	}, a, nil
+}
+
+// PUT /absence/{id}
+func updateAbsence(u *url.URL, h http.Header, a *absence) (int, http.Header, *absence, error) {
+	ctx := ql.NewRWCtx()
+	old, status, err := fetchAbsence(ctx, u, "updateAbsence")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	a.ID = old.ID
+	if status, err := a.validate(ctx, "updateAbsence"); err != nil {
+		return status, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qUpdateAbsence, a.Person, a.Kind, a.Start, a.End, a.Substitute, a.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateAbsence", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	log.Info("absence updated", log.Ctx{"ID": a.ID, "Person": a.Person, "Kind": a.Kind, "Start": a.Start, "End": a.End})
+
+	return http.StatusOK, nil, a, nil
+}
+
+// DELETE /absence/{id}
+func deleteAbsence(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+	ctx := ql.NewRWCtx()
+	a, status, err := fetchAbsence(ctx, u, "deleteAbsence")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qDeleteAbsence, a.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "deleteAbsence", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	log.Info("absence deleted", log.Ctx{"ID": a.ID})
+
+	return http.StatusNoContent, nil, nil, nil
+}
+
+// absencesCalendar returns the absences as an iCalendar, with the names of
+// the persons in names.
+func absencesCalendar(as []*absence, names map[int64]string) []byte {
+	var b bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		foldLine(&b, fmt.Sprintf(format, args...))
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//digibib//folk//NO")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:Fravær")
+	for _, a := range as {
+		start, _ := time.Parse(dateLayout, a.Start)
+		end, _ := time.Parse(dateLayout, a.End)
+		line("BEGIN:VEVENT")
+		line("UID:absence-%d@folk", a.ID)
+		line("DTSTAMP:%s", stamp)
+		line("DTSTART;VALUE=DATE:%s", start.Format("20060102"))
+		// DTEND is exclusive; the absence includes its last day.
+		line("DTEND;VALUE=DATE:%s", end.AddDate(0, 0, 1).Format("20060102"))
+		line("SUMMARY:%s", escapeText(fmt.Sprintf("%s: %s", names[a.Person], absenceKinds[a.Kind])))
+		if a.Substitute != 0 {
+			line("DESCRIPTION:%s", escapeText("Stedfortreder: "+names[a.Substitute]))
+		}
+		line("TRANSP:TRANSPARENT")
+		line("END:VEVENT")
+	}
+	line("END:VCALENDAR")
+	return b.Bytes()
+}
+
+// GET /absences.ics
+//
+// absencesICS serves current and future absences as an iCalendar feed,
+// filtered as described by filterAbsences; typically by department.
+func absencesICS(w http.ResponseWriter, r *http.Request) {
+	ctx := readCtx
+	as, status, err := filterAbsences(ctx, r.URL, "absencesICS")
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	rs, _, err := db.Execute(ctx, qPersonNames)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "absencesICS", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+	names := make(map[int64]string)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		names[data[0].(int64)] = data[1].(string)
+		return true, nil
+	}); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "absencesICS", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(absencesCalendar(as, names))
+}
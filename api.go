@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -38,6 +40,135 @@ BEGIN TRANSACTION;
 		Updated time
 	);
 
+	CREATE TABLE IF NOT EXISTS Image (
+		Filename string,
+		Alt string,
+		Photographer string,
+		Licence string,
+		Consent string,
+		Uploaded time
+	);
+
+	CREATE TABLE IF NOT EXISTS PersonImage (
+		Person int64,
+		Filename string,
+		Label string,
+		Position int64,
+		Primary bool
+	);
+
+	CREATE TABLE IF NOT EXISTS ImageUse (
+		Filename string,
+		LastUsed time
+	);
+
+	CREATE TABLE IF NOT EXISTS FieldDef (
+		Name string,
+		Label string,
+		Type string,
+		OptionList string,
+		Required bool,
+		Public bool,
+		Indexed bool
+	);
+
+	CREATE TABLE IF NOT EXISTS FieldValue (
+		Person int64,
+		Field int64,
+		Value string
+	);
+
+	CREATE TABLE IF NOT EXISTS Membership (
+		Person int64,
+		Dept int64,
+		Role string,
+		Primary bool,
+		Percent int64
+	);
+
+	CREATE TABLE IF NOT EXISTS Tag (
+		Name string,
+		Kind string
+	);
+
+	CREATE TABLE IF NOT EXISTS PersonTag (
+		Person int64,
+		Tag int64
+	);
+
+	CREATE TABLE IF NOT EXISTS Subject (
+		Person int64,
+		Low string,
+		High string,
+		Label string
+	);
+
+	CREATE TABLE IF NOT EXISTS Location (
+		Person int64,
+		Branch string,
+		Building string,
+		Floor string,
+		Room string
+	);
+
+	CREATE TABLE IF NOT EXISTS Absence (
+		Person int64,
+		Kind string,
+		Start string,
+		End string,
+		Substitute int64
+	);
+
+	CREATE TABLE IF NOT EXISTS Employment (
+		Person int64,
+		Start string,
+		End string
+	);
+
+	CREATE TABLE IF NOT EXISTS DepartmentUpdated (
+		Department int64,
+		Updated time
+	);
+
+	CREATE TABLE IF NOT EXISTS PersonSortName (
+		Person int64,
+		Name string
+	);
+
+	CREATE TABLE IF NOT EXISTS PersonCreated (
+		Person int64,
+		Created time
+	);
+
+	CREATE TABLE IF NOT EXISTS Webhook (
+		URL string,
+		Secret string,
+		EventList string,
+		Paused bool
+	);
+
+	CREATE TABLE IF NOT EXISTS WebhookDelivery (
+		Webhook int64,
+		Event string,
+		Payload string,
+		Attempts int64,
+		NextAttempt time,
+		Status string,
+		LastStatus int64,
+		LastError string,
+		Created time,
+		Delivered time
+	);
+
+	CREATE TABLE IF NOT EXISTS Contact (
+		Person int64,
+		Kind string,
+		Value string,
+		Public bool,
+		Preferred bool,
+		Position int64
+	);
+
 COMMIT;
 `)
 	qGetDept        = ql.MustCompile(`SELECT id(), Name, Parent FROM Department WHERE id() == $1`)
@@ -45,14 +176,22 @@ COMMIT;
 	qInsertDept     = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Department VALUES($1, $2); COMMIT;`)
 	qDeleteDept     = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Department WHERE id() == $1; COMMIT;`)
 	qUpdateDept     = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Department SET Name = $1, Parent = $2 WHERE id() == $3; COMMIT;`)
-	qDeptHasPersons = ql.MustCompile(`SELECT id() FROM Person WHERE Dept == $1;`)
+	qDeptHasPersons = ql.MustCompile(`SELECT DISTINCT Person FROM Membership WHERE Dept == $1;`)
 	qDeptHasDept    = ql.MustCompile(`SELECT id() FROM Department WHERE Parent == $1;`)
 	qGetPerson      = ql.MustCompile(`SELECT id(), Name, Dept, Email, Img, Role, Info, Phone, Updated FROM Person WHERE id() == $1`)
-	qGetAllPersons  = ql.MustCompile(`SELECT id(), Name, Dept, Email, Img, Role, Info, Phone, Updated FROM Person ORDER BY id() DESC LIMIT $2 OFFSET $1;`)
+	qAllPersons     = ql.MustCompile(`SELECT id(), Name, Dept, Email, Img, Role, Info, Phone, Updated FROM Person ORDER BY id() DESC;`)
 	qInsertPerson   = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Person VALUES($1, $2, $3, $4, $5, $6, $7, now()); COMMIT;`)
 	qUpdatePerson   = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Person SET Name = $1, Dept = $2, Email = $3, Img = $4, Role = $5, Info = $6, Phone = $7, Updated = now() WHERE id() == $8; COMMIT;`)
 	qDeletePerson   = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Person WHERE id() == $1; COMMIT;`)
+	qSetPersonImg   = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Person SET Img = $1, Updated = now() WHERE id() == $2; COMMIT;`)
 	qImageUsed      = ql.MustCompile(`SELECT id() FROM Person WHERE Img == $1;`)
+	qGetAllImages   = ql.MustCompile(`SELECT Filename, Alt, Photographer, Licence, Consent, Uploaded FROM Image;`)
+	qInsertImage    = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Image WHERE Filename == $1; INSERT INTO Image VALUES($1, $2, $3, $4, $5, $6); COMMIT;`)
+	qUpdateImage    = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Image SET Alt = $2, Photographer = $3, Licence = $4, Consent = $5 WHERE Filename == $1; COMMIT;`)
+	qDeleteImage    = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Image WHERE Filename == $1; COMMIT;`)
+	qImageLastUsed  = ql.MustCompile(`SELECT LastUsed FROM ImageUse WHERE Filename == $1;`)
+	qTouchImage     = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM ImageUse WHERE Filename == $1; INSERT INTO ImageUse VALUES($1, now()); COMMIT;`)
+	qForgetImage    = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM ImageUse WHERE Filename == $1; COMMIT;`)
 )
 
 type department struct {
@@ -62,15 +201,107 @@ type department struct {
 }
 
 type person struct {
-	ID      int64
-	Name    string
-	Dept    int64
-	Email   string
-	Img     string
-	Role    string
-	Info    string
-	Phone   string
-	Updated time.Time
+	ID          int64
+	Name        string
+	Dept        int64  // the primary department
+	Email       string // the preferred email address
+	Img         string
+	Role        string // the role in the primary department
+	Info        string
+	Phone       string // the preferred phone number
+	Updated     time.Time
+	Created     time.Time         `ql:"-"` // read only
+	SortName    string            `ql:"-"` // the name as sorted by; the family name first, by default
+	ImgAlt      string            `ql:"-"` // alternative text of Img; read only
+	Images      []*personImage    `ql:"-"` // all images, Img being the primary; read only
+	Fields      map[string]string `ql:"-"` // custom field values, by field name
+	Phones      []*contact        `ql:"-"` // all phone numbers, Phone being the preferred
+	Emails      []*contact        `ql:"-"` // all email addresses, Email being the preferred
+	Memberships []*membership     `ql:"-"` // all departments, Dept being the primary
+	Tags        []string          `ql:"-"` // names of skill, subject and language tags
+	Subjects    []*subject        `ql:"-"` // Dewey ranges the person is responsible for
+	Location    *location         `ql:"-"` // where the person sits
+	Absence     *absence          `ql:"-"` // the current absence, nil if present; read only
+	Employment  *employment       `ql:"-"` // the period the person is employed
+}
+
+// image holds the metadata of an uploaded image file.
+type image struct {
+	Filename     string
+	Alt          string // alternative text, for screen readers
+	Photographer string
+	Licence      string
+	Consent      string // consent to publish: "", "pending", "given" or "withdrawn"
+	Uploaded     time.Time
+}
+
+// validConsent reports whether s is a known consent status.
+func validConsent(s string) bool {
+	switch s {
+	case "", "pending", "given", "withdrawn":
+		return true
+	}
+	return false
+}
+
+// setPersonDetails fills in the fields of persons which are not stored in
+// the Person table.
+func setPersonDetails(ctx *ql.TCtx, ps ...*person) error {
+	setImgAlt(ps...)
+	if err := setPersonFields(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonContacts(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonMemberships(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonTags(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonSubjects(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonLocations(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonAbsences(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonEmployments(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonCreated(ctx, ps...); err != nil {
+		return err
+	}
+	if err := setPersonSortNames(ctx, ps...); err != nil {
+		return err
+	}
+	return setPersonImages(ctx, ps...)
+}
+
+// hideInternal removes the information about persons which is only to be
+// shown internally.
+func hideInternal(ps ...*person) {
+	hideInternalFields(ps...)
+	hideInternalContacts(ps...)
+}
+
+// indexText returns the text by which the person can be found when searching.
+func (p *person) indexText() string {
+	return fmt.Sprintf("%v %v%v %v %v %v %v %v %v", p.Name, p.Role, membershipsIndexText(p), p.Info, strings.Join(p.Tags, " "), subjectsIndexText(p), locationIndexText(p), contactsIndexText(p), fieldsIndexText(p.Fields))
+}
+
+// setImgAlt fills in the alternative text of the persons' images.
+func setImgAlt(ps ...*person) {
+	for _, p := range ps {
+		if img := imageFiles.get(p.Img); img != nil {
+			p.ImgAlt = img.Alt
+		} else {
+			p.ImgAlt = ""
+		}
+	}
 }
 
 type deletedMsg struct {
@@ -78,10 +309,43 @@ type deletedMsg struct {
 	ID   int64
 }
 
+// unusedImage is an image not used by any person.
+type unusedImage struct {
+	Filename string
+	LastUsed time.Time // when the image was last used, or uploaded
+}
+
+// imageGCReport is the result of a garbage collection run of unused images.
+type imageGCReport struct {
+	DryRun  bool
+	Days    int
+	Checked int
+	Unused  []unusedImage // images not used for at least Days days
+	Removed []string      // removed images; empty on dry run
+}
+
 type searchResults struct {
 	TookMs float64
-	Count  int
-	Hits   []int
+	Count  int   // of all hits
+	Hits   []int // the page of hits
+}
+
+// writeError writes err as a JSON error response, in the same format as the
+// handlers wrapped by tigertonic.Marshaled.
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{
+		"description": err.Error(),
+		"error":       "error",
+	})
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error("failed to encode JSON response", log.Ctx{"error": err.Error()})
+	}
 }
 
 // srAsIntSet returns a integer set out of a search result from an index.
@@ -93,6 +357,51 @@ func srAsIntSet(sr *index.SearchResults) *intset.BitSet {
 	return s
 }
 
+// fetchPerson returns the person with the given ID, or nil if there is no
+// such person.
+func fetchPerson(ctx *ql.TCtx, id int64) (*person, error) {
+	rs, _, err := db.Execute(ctx, qGetPerson, id)
+	if err != nil {
+		return nil, err
+	}
+
+	row, err := rs[0].FirstRow()
+	if err != nil || row == nil {
+		return nil, err
+	}
+
+	p := &person{}
+	if err = ql.Unmarshal(p, row); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// allPersons returns all persons, with details.
+func allPersons(ctx *ql.TCtx) ([]*person, error) {
+	rs, _, err := db.Execute(ctx, qAllPersons)
+	if err != nil {
+		return nil, err
+	}
+
+	persons := []*person{}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		p := &person{}
+		if err := ql.Unmarshal(p, data); err != nil {
+			return false, err
+		}
+		persons = append(persons, p)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := setPersonDetails(ctx, persons...); err != nil {
+		return nil, err
+	}
+	return persons, nil
+}
+
 // createSchema creates the database tables, if they don't allready exists.
 func createSchema(db *ql.DB) error {
 	ctx := ql.NewRWCtx()
@@ -137,14 +446,62 @@ func setupAPIRouting() {
 		"PUT",
 		"/department/{id}",
 		tigertonic.Marshaled(updateDepartment))
+	apiMux.HandleFunc(
+		"PATCH",
+		"/department/{id}",
+		patchDepartment)
+	apiMux.Handle(
+		"POST",
+		"/department/{id}/merge-into/{target}",
+		tigertonic.Marshaled(mergeDepartment))
+	apiMux.Handle(
+		"POST",
+		"/department/{id}/split",
+		tigertonic.Marshaled(splitDepartment))
+	apiMux.Handle(
+		"GET",
+		"/department/{id}/persons",
+		tigertonic.Marshaled(getDepartmentPersons))
 	apiMux.Handle(
 		"GET",
 		"/person/{id}",
 		tigertonic.Marshaled(getPerson))
+	apiMux.HandleFunc(
+		"PATCH",
+		"/person/{id}",
+		patchPerson)
+	apiMux.HandleFunc(
+		"GET",
+		"/person/{id}/avatar",
+		avatarHandler)
+	apiMux.HandleFunc(
+		"PUT",
+		"/person/{id}/image",
+		setPersonImage)
+	apiMux.HandleFunc(
+		"GET",
+		"/person/{id}/vcard",
+		vcardHandler)
+	apiMux.Handle(
+		"GET",
+		"/person/{id}/images",
+		tigertonic.Marshaled(getPersonImages))
+	apiMux.Handle(
+		"POST",
+		"/person/{id}/images",
+		tigertonic.Marshaled(addPersonImage))
+	apiMux.Handle(
+		"PUT",
+		"/person/{id}/images",
+		tigertonic.Marshaled(reorderPersonImages))
+	apiMux.Handle(
+		"DELETE",
+		"/person/{id}/images/{filename}",
+		tigertonic.Marshaled(removePersonImage))
 	apiMux.Handle(
 		"GET",
 		"/person",
-		tigertonic.Marshaled(getAllPersons))
+		tigertonic.Marshaled(getPersons))
 	apiMux.Handle(
 		"POST",
 		"/person",
@@ -161,10 +518,130 @@ func setupAPIRouting() {
 		"GET",
 		"/images",
 		tigertonic.Marshaled(getImages))
+	apiMux.Handle(
+		"GET",
+		"/images/usage",
+		tigertonic.Marshaled(getImageUsage))
+	apiMux.Handle(
+		"POST",
+		"/images/gc",
+		tigertonic.Marshaled(collectImages))
+	apiMux.Handle(
+		"POST",
+		"/persons/purge",
+		tigertonic.Marshaled(purgePersons))
+	apiMux.Handle(
+		"GET",
+		"/image/{filename}",
+		tigertonic.Marshaled(getImage))
+	apiMux.Handle(
+		"PUT",
+		"/image/{filename}",
+		tigertonic.Marshaled(updateImage))
 	apiMux.Handle(
 		"DELETE",
 		"/image/{filename}",
 		tigertonic.Marshaled(deleteImage))
+	apiMux.HandleFunc(
+		"GET",
+		"/export/persons.csv",
+		exportPersons)
+	apiMux.Handle(
+		"GET",
+		"/absence",
+		tigertonic.Marshaled(getAbsences))
+	apiMux.Handle(
+		"POST",
+		"/absence",
+		tigertonic.Marshaled(createAbsence))
+	apiMux.Handle(
+		"PUT",
+		"/absence/{id}",
+		tigertonic.Marshaled(updateAbsence))
+	apiMux.Handle(
+		"DELETE",
+		"/absence/{id}",
+		tigertonic.Marshaled(deleteAbsence))
+	apiMux.HandleFunc(
+		"GET",
+		"/absences.ics",
+		absencesICS)
+	apiMux.Handle(
+		"GET",
+		"/field",
+		tigertonic.Marshaled(getFieldDefs))
+	apiMux.Handle(
+		"POST",
+		"/field",
+		tigertonic.Marshaled(createFieldDef))
+	apiMux.Handle(
+		"PUT",
+		"/field/{id}",
+		tigertonic.Marshaled(updateFieldDef))
+	apiMux.Handle(
+		"DELETE",
+		"/field/{id}",
+		tigertonic.Marshaled(deleteFieldDef))
+	apiMux.Handle(
+		"GET",
+		"/tags",
+		tigertonic.Marshaled(getTags))
+	apiMux.Handle(
+		"POST",
+		"/tags",
+		tigertonic.Marshaled(createTag))
+	apiMux.Handle(
+		"PUT",
+		"/tags/{tag}",
+		tigertonic.Marshaled(updateTag))
+	apiMux.Handle(
+		"DELETE",
+		"/tags/{tag}",
+		tigertonic.Marshaled(deleteTag))
+	apiMux.Handle(
+		"GET",
+		"/tags/{tag}/persons",
+		tigertonic.Marshaled(getTagPersons))
+	apiMux.Handle(
+		"POST",
+		"/tags/{tag}/merge-into/{target}",
+		tigertonic.Marshaled(mergeTag))
+	apiMux.Handle(
+		"GET",
+		"/subject",
+		tigertonic.Marshaled(getSubject))
+	apiMux.Handle(
+		"GET",
+		"/webhook",
+		tigertonic.Marshaled(getWebhooks))
+	apiMux.Handle(
+		"POST",
+		"/webhook",
+		tigertonic.Marshaled(createWebhook))
+	apiMux.Handle(
+		"PUT",
+		"/webhook/{id}",
+		tigertonic.Marshaled(updateWebhook))
+	apiMux.Handle(
+		"DELETE",
+		"/webhook/{id}",
+		tigertonic.Marshaled(deleteWebhook))
+	apiMux.Handle(
+		"GET",
+		"/webhook/{id}/deliveries",
+		tigertonic.Marshaled(getDeliveries))
+	apiMux.Handle(
+		"POST",
+		"/webhook/{id}/test",
+		tigertonic.Marshaled(testWebhook))
+	apiMux.Handle(
+		"POST",
+		"/batch",
+		tigertonic.Marshaled(runBatch))
+	apiMux.HandleFunc(
+		"GET",
+		"/events",
+		eventsHandler)
 	apiMux.Handle(
 		"GET",
 		"/search",
@@ -172,10 +649,70 @@ func setupAPIRouting() {
 }
 
 // GET /images
-func getImages(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []string, error) {
-	imageFiles.RLock()
-	defer imageFiles.RUnlock()
-	return http.StatusOK, nil, imageFiles.list, nil
+func getImages(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*image, error) {
+	// Other instances may share the image store, so make sure the list
+	// is up to date.
+	if err := loadImages(); err != nil {
+		log.Error("failed to list images", log.Ctx{"function": "getImages", "error": err.Error()})
+	}
+
+	return http.StatusOK, nil, imageFiles.all(), nil
+}
+
+// GET /image/{filename}
+func getImage(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *image, error) {
+	filename := u.Query().Get("filename")
+	if filename == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("missing filename parameter")
+	}
+
+	img := imageFiles.get(filename)
+	if img == nil {
+		return http.StatusNotFound, nil, nil, errors.New("image not found")
+	}
+
+	return http.StatusOK, nil, img, nil
+}
+
+// PUT /image/{filename}
+func updateImage(u *url.URL, h http.Header, img *image) (int, http.Header, *image, error) {
+	filename := u.Query().Get("filename")
+	if filename == "" {
+		return http.StatusBadRequest, nil, nil, errors.New("missing filename parameter")
+	}
+
+	if !validConsent(img.Consent) {
+		return http.StatusBadRequest, nil, nil, errors.New("consent must be one of \"pending\", \"given\" or \"withdrawn\"")
+	}
+
+	old := imageFiles.get(filename)
+	if old == nil {
+		return http.StatusNotFound, nil, nil, errors.New("image not found")
+	}
+
+	img.Filename = filename
+	img.Uploaded = old.Uploaded
+
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qUpdateImage, img.Filename, img.Alt, img.Photographer, img.Licence, img.Consent); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateImage", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	// Images uploaded before metadata was stored don't have a row yet.
+	if ctx.RowsAffected == 0 {
+		if _, _, err := db.Execute(ctx, qInsertImage, ql.MustMarshal(img)...); err != nil {
+			log.Error("failed insert into table Image", log.Ctx{"function": "updateImage", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+		}
+	}
+
+	imageFiles.set(img)
+
+	log.Info("image updated", log.Ctx{"filename": filename, "Alt": img.Alt, "Photographer": img.Photographer, "Licence": img.Licence, "Consent": img.Consent})
+	emitEvent("image.updated", img)
+
+	return http.StatusOK, nil, img, nil
 }
 
 // DELETE /image/{filename}
@@ -188,40 +725,172 @@ func deleteImage(u *url.URL, h http.Header, _ interface{}) (int, http.Header, in
 	// Make sure the image file is not associated with any person.
 	ctx := ql.NewRWCtx()
 
-	rs, _, err := db.Execute(ctx, qImageUsed, filename)
+	users, err := imageUsers(ctx, filename)
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "deleteImage", "error": err.Error()})
 		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
 	}
 
-	row, err := rs[0].FirstRow()
-	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "deleteImage", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
-	}
-
-	if row != nil {
+	if len(users) > 0 {
 		return http.StatusBadRequest, nil, nil, errors.New("image is in use; cannot delete")
 	}
 
-	err = os.Remove(fmt.Sprintf("data/public/img/%s", filename))
+	err = removeImage(ctx, filename)
+	if err == errInvalidImageName {
+		return http.StatusBadRequest, nil, nil, err
+	}
 	if err != nil {
 		log.Error("failed to delete file", log.Ctx{"error": err.Error()})
 		return http.StatusInternalServerError, nil, nil, errors.New("failed to delete file")
 	}
 
-	imageFiles.Lock()
-	for i, f := range imageFiles.list {
-		if f == filename {
-			imageFiles.list = append(imageFiles.list[:i], imageFiles.list[i+1:]...)
-			break
+	log.Info("image deleted", log.Ctx{"filename": filename})
+
+	return http.StatusNoContent, nil, nil, nil
+}
+
+// imageUsers returns the IDs of the persons using the given image, either as
+// their primary image or as one of their other images.
+func imageUsers(ctx *ql.TCtx, filename string) ([]int64, error) {
+	ids := []int64{}
+	seen := make(map[int64]bool)
+	for _, q := range []ql.List{qImageUsed, qImageInSet} {
+		rs, _, err := db.Execute(ctx, q, filename)
+		if err != nil {
+			return nil, err
+		}
+
+		err = rs[0].Do(false, func(data []interface{}) (bool, error) {
+			id := data[0].(int64)
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
-	imageFiles.Unlock()
+	return ids, nil
+}
+
+// removeImage deletes an image from the image store and from the list of
+// uploaded images. It does not check if the image is in use.
+func removeImage(ctx *ql.TCtx, filename string) error {
+	err := imgStore.Delete(filename)
+	if err != nil && err != errImageNotFound {
+		return err
+	}
 
-	log.Info("image deleted", log.Ctx{"filename": filename})
+	imageFiles.remove(filename)
 
-	return http.StatusNoContent, nil, nil, nil
+	if _, _, err := db.Execute(ctx, qForgetImage, filename); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "removeImage", "error": err.Error()})
+	}
+	if _, _, err := db.Execute(ctx, qDeleteImage, filename); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "removeImage", "error": err.Error()})
+	}
+	emitEvent("image.deleted", map[string]string{"Filename": filename})
+	return nil
+}
+
+// releaseImage records that an image stopped being used by a person, so that
+// it can be garbage collected later.
+func releaseImage(ctx *ql.TCtx, filename string) {
+	if filename == "" {
+		return
+	}
+	if _, _, err := db.Execute(ctx, qTouchImage, filename); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "releaseImage", "error": err.Error()})
+	}
+}
+
+// GET /images/usage
+func getImageUsage(u *url.URL, h http.Header, _ interface{}) (int, http.Header, map[string][]int64, error) {
+	files := imageFiles.all()
+
+	ctx := readCtx
+	usage := make(map[string][]int64, len(files))
+	for _, f := range files {
+		ids, err := imageUsers(ctx, f.Filename)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "getImageUsage", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		usage[f.Filename] = ids
+	}
+
+	return http.StatusOK, nil, usage, nil
+}
+
+// POST /images/gc?days=N&dryrun=true
+func collectImages(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *imageGCReport, error) {
+	days, err := strconv.Atoi(u.Query().Get("days"))
+	if err != nil || days < 1 {
+		return http.StatusBadRequest, nil, nil, errors.New("days parameter must be a positive integer")
+	}
+
+	// Only remove images when explicitly asked to.
+	dryRun := true
+	if s := u.Query().Get("dryrun"); s != "" {
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			return http.StatusBadRequest, nil, nil, errors.New("dryrun parameter must be a boolean")
+		}
+	}
+
+	infos, err := imgStore.List()
+	if err != nil {
+		log.Error("failed to list images", log.Ctx{"function": "collectImages", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("failed to list images")
+	}
+
+	report := &imageGCReport{DryRun: dryRun, Days: days, Checked: len(infos), Unused: []unusedImage{}, Removed: []string{}}
+	cutoff := time.Now().AddDate(0, 0, -days)
+	ctx := ql.NewRWCtx()
+	for _, info := range infos {
+		ids, err := imageUsers(ctx, info.Name)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "collectImages", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		if len(ids) > 0 {
+			continue
+		}
+
+		lastUsed := info.Modified
+		rs, _, err := db.Execute(ctx, qImageLastUsed, info.Name)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "collectImages", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		row, err := rs[0].FirstRow()
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "collectImages", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		if row != nil && row[0].(time.Time).After(lastUsed) {
+			lastUsed = row[0].(time.Time)
+		}
+		if lastUsed.After(cutoff) {
+			continue
+		}
+
+		report.Unused = append(report.Unused, unusedImage{Filename: info.Name, LastUsed: lastUsed})
+		if dryRun {
+			continue
+		}
+		if err := removeImage(ctx, info.Name); err != nil {
+			log.Error("failed to delete file", log.Ctx{"function": "collectImages", "filename": info.Name, "error": err.Error()})
+			continue
+		}
+		report.Removed = append(report.Removed, info.Name)
+	}
+
+	log.Info("unused images collected", log.Ctx{"dryRun": dryRun, "days": days, "unused": len(report.Unused), "removed": len(report.Removed)})
+
+	return http.StatusOK, nil, report, nil
 }
 
 // GET /department/{id}
@@ -235,7 +904,7 @@ func getDepartment(u *url.URL, h http.Header, _ interface{}) (int, http.Header,
 		return http.StatusBadRequest, nil, nil, errors.New("department ID must be an integer")
 	}
 
-	ctx := ql.NewRWCtx()
+	ctx := readCtx
 
 	rs, _, err := db.Execute(ctx, qGetDept, int64(id))
 	if err != nil {
@@ -258,13 +927,19 @@ func getDepartment(u *url.URL, h http.Header, _ interface{}) (int, http.Header,
 		log.Error("failed to marshal db row", log.Ctx{"function": "getDepartment", "error": err.Error()})
 		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
 	}
-	return http.StatusOK, nil, &dept, nil
+
+	updated, err := deptUpdated(ctx, dept.ID)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getDepartment", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	return http.StatusOK, versionHeaders(updated), &dept, nil
 }
 
 // GET /department
 func getAllDepartments(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*department, error) {
 
-	ctx := ql.NewRWCtx()
+	ctx := readCtx
 	rs, _, err := db.Run(ctx, qGetAllDepts)
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "getAllDepartments", "error": err.Error()})
@@ -286,41 +961,73 @@ func getAllDepartments(u *url.URL, h http.Header, _ interface{}) (int, http.Head
 		}
 	}
 
-	// Sort departments by subdepartments following their parent department
+	// Sort departments by name, in Norwegian order, with subdepartments
+	// following their parent department
 	departments := make([]*department, 0)
+	l := &listing{
+		order: "name",
+		swap:  func(i, j int) { departments[i], departments[j] = departments[j], departments[i] },
+	}
 	for _, main := range sortedDepts[0] {
+		key := collationKey(main.Name) + "\x00" + idKey(main.ID)
 		departments = append(departments, main)
+		l.keys = append(l.keys, key)
 		for _, sub := range sortedDepts[main.ID] {
 			departments = append(departments, sub)
+			l.keys = append(l.keys, key+"\x01"+collationKey(sub.Name)+"\x00"+idKey(sub.ID))
 		}
 	}
-	return http.StatusOK, nil, departments, nil
+	sort.Sort(l)
+
+	from, to, header, err := l.page(u, -1)
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	return http.StatusOK, header, departments[from:to], nil
 }
 
 // POST /department
 func createDepartment(u *url.URL, h http.Header, dept *department) (int, http.Header, *department, error) {
+	var updated time.Time
+	status, err := inTransaction("createDepartment", func(ctx *ql.TCtx, after *afterCommit) (status int, err error) {
+		updated, status, err = addDepartment(ctx, after, dept)
+		return status, err
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	header := versionHeaders(updated)
+	header.Set("Content-Location", fmt.Sprintf("%s://%s/api/department/%d", u.Scheme, u.Host, dept.ID))
+	return http.StatusCreated, header, dept, nil
+}
+
+// addDepartment creates the department, and returns when it was modified.
+// The event is emitted after commit. On failure it returns the HTTP status
+// code to respond with.
+func addDepartment(ctx *ql.TCtx, after *afterCommit, dept *department) (time.Time, int, error) {
 	if strings.TrimSpace(dept.Name) == "" {
-		return http.StatusBadRequest, nil, nil, errors.New("department must have a name")
+		return time.Time{}, http.StatusBadRequest, errors.New("department must have a name")
 	}
 
-	ctx := ql.NewRWCtx()
 	if _, _, err := db.Execute(ctx, qInsertDept, ql.MustMarshal(dept)...); err != nil {
 		log.Error("failed insert into table Department", log.Ctx{"function": "createDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+		return time.Time{}, http.StatusInternalServerError, errors.New("database insert failed")
 	}
 
 	dept.ID = ctx.LastInsertID
 
+	updated, err := touchDept(ctx, dept.ID)
+	if err != nil {
+		log.Error("failed insert into table DepartmentUpdated", log.Ctx{"function": "createDepartment", "error": err.Error()})
+		return time.Time{}, http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
 	log.Info("department created", log.Ctx{"ID": dept.ID, "Name": dept.Name})
-	return http.StatusCreated, http.Header{
-			"Content-Location": {fmt.Sprintf(
-				"%s://%s/api/department/%d",
-				u.Scheme,
-				u.Host,
-				dept.ID,
-			)},
-		},
-		dept, nil
+	after.add(func() {
+		emitEvent("department.created", dept)
+	})
+	return updated, http.StatusCreated, nil
 }
 
 // DELETE /department/{id}
@@ -334,56 +1041,75 @@ func deleteDepartment(u *url.URL, h http.Header, _ interface{}) (int, http.Heade
 		return http.StatusBadRequest, nil, nil, errors.New("department ID must be an integer")
 	}
 
-	ctx := ql.NewRWCtx()
+	status, err := inTransaction("deleteDepartment", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		return removeDepartment(ctx, after, id)
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
 
+	return http.StatusNoContent, nil, nil, nil
+}
+
+// removeDepartment deletes the department with the given ID, which must have
+// no staff or subdepartments. The event is emitted after commit. On failure
+// it returns the HTTP status code to respond with.
+func removeDepartment(ctx *ql.TCtx, after *afterCommit, id int) (int, error) {
 	// Make sure department does not have any persons associated with it.
 	rs, _, err := db.Execute(ctx, qDeptHasPersons, int64(id))
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "deleteDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	row, err := rs[0].FirstRow()
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "deleteDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	if row != nil {
-		return http.StatusBadRequest, nil, nil, errors.New("cannot delete department with associated staff")
+		return http.StatusBadRequest, errors.New("cannot delete department with associated staff")
 	}
 
 	// Make sure department has no subdepartments
 	rs, _, err = db.Execute(ctx, qDeptHasDept, int64(id))
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "deleteDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	row, err = rs[0].FirstRow()
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "deleteDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	if row != nil {
-		return http.StatusBadRequest, nil, nil, errors.New("cannot delete department with subdepartments")
+		return http.StatusBadRequest, errors.New("cannot delete department with subdepartments")
 	}
 
 	// Try to delete
 	rs, _, err = db.Execute(ctx, qDeleteDept, int64(id))
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "deleteDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	if ctx.RowsAffected == 0 {
-		return http.StatusNotFound, nil, nil, errors.New("department does not exist")
+		return http.StatusNotFound, errors.New("department does not exist")
+	}
+
+	if _, _, err := db.Execute(ctx, qDeleteDeptUpdated, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "deleteDepartment", "error": err.Error()})
 	}
 
 	log.Info("department deleted", log.Ctx{"ID": id})
+	after.add(func() {
+		emitEvent("department.deleted", deletedMsg{Type: "department", ID: int64(id)})
+	})
 
-	return http.StatusNoContent, nil, nil, nil
+	return http.StatusNoContent, nil
 }
 
 // PUT /department/{id}
@@ -396,21 +1122,69 @@ func updateDepartment(u *url.URL, h http.Header, dept *department) (int, http.He
 	if err != nil {
 		return http.StatusBadRequest, nil, nil, errors.New("department ID must be an integer")
 	}
-
-	if strings.TrimSpace(dept.Name) == "" {
-		return http.StatusBadRequest, nil, nil, errors.New("department must have a name")
+
+	// If-Match is checked in the same transaction as the department is
+	// updated in, so two updates of the same version cannot both pass.
+	var updated time.Time
+	status, err := inTransaction("updateDepartment", func(ctx *ql.TCtx, after *afterCommit) (status int, err error) {
+		updated, status, err = changeDepartment(ctx, after, id, h, dept)
+		return status, err
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	return http.StatusOK, versionHeaders(updated), dept, nil
+}
+
+// changeDepartment updates the department with the given ID, unless If-Match
+// in h doesn't match, and returns when it was modified. The event is emitted
+// after commit. On failure it returns the HTTP status code to respond with.
+func changeDepartment(ctx *ql.TCtx, after *afterCommit, id int, h http.Header, dept *department) (time.Time, int, error) {
+	if strings.TrimSpace(dept.Name) == "" {
+		return time.Time{}, http.StatusBadRequest, errors.New("department must have a name")
+	}
+
+	dept.ID = int64(id)
+
+	// The department cannot be moved below itself.
+	cycle, err := inSubtree(ctx, dept.Parent, dept.ID)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateDepartment", "error": err.Error()})
+		return time.Time{}, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	if cycle {
+		return time.Time{}, http.StatusBadRequest, errors.New("department cannot be moved below itself")
+	}
+
+	updated, err := deptUpdated(ctx, dept.ID)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateDepartment", "error": err.Error()})
+		return time.Time{}, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	if !ifMatch(h, etag(updated)) {
+		return time.Time{}, http.StatusPreconditionFailed, errPreconditionFailed
 	}
 
-	ctx := ql.NewRWCtx()
-	dept.ID = int64(id)
 	if _, _, err := db.Execute(ctx, qUpdateDept, dept.Name, dept.Parent, dept.ID); err != nil {
 		log.Error("database query failed", log.Ctx{"function": "updateDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return time.Time{}, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	if ctx.RowsAffected == 0 {
+		return time.Time{}, http.StatusNotFound, errors.New("department does not exist")
+	}
+
+	if updated, err = touchDept(ctx, dept.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateDepartment", "error": err.Error()})
+		return time.Time{}, http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	log.Info("department updated", log.Ctx{"ID": id, "Name": dept.Name})
+	after.add(func() {
+		emitEvent("department.updated", dept)
+	})
 
-	return http.StatusOK, nil, dept, nil
+	return updated, http.StatusOK, nil
 }
 
 // GET /person/{id}
@@ -424,7 +1198,7 @@ func getPerson(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *per
 		return http.StatusBadRequest, nil, nil, errors.New("person ID must be an integer")
 	}
 
-	ctx := ql.NewRWCtx()
+	ctx := readCtx
 
 	rs, _, err := db.Execute(ctx, qGetPerson, int64(id))
 	if err != nil {
@@ -447,60 +1221,146 @@ func getPerson(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *per
 		log.Error("failed to marshal db row", log.Ctx{"function": "getPerson", "error": err.Error()})
 		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
 	}
-	return http.StatusOK, nil, &p, nil
+	if err = setPersonDetails(ctx, &p); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if !showInternal(u) {
+		hideInternal(&p)
+	}
+	return http.StatusOK, versionHeaders(p.Updated), &p, nil
 }
 
 // POST /person
 func createPerson(u *url.URL, h http.Header, p *person) (int, http.Header, *person, error) {
+	status, err := inTransaction("createPerson", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		return addPerson(ctx, after, p)
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	header := versionHeaders(p.Updated)
+	header.Set("Content-Location", fmt.Sprintf("%s://%s/api/person/%d", u.Scheme, u.Host, p.ID))
+	return http.StatusCreated, header, p, nil
+}
+
+// addPerson creates the person. The search index is updated and the event
+// emitted after commit. On failure it returns the HTTP status code to respond
+// with.
+func addPerson(ctx *ql.TCtx, after *afterCommit, p *person) (int, error) {
 	if strings.TrimSpace(p.Name) == "" {
-		return http.StatusBadRequest, nil, nil, errors.New("person must have a name")
+		return http.StatusBadRequest, errors.New("person must have a name")
 	}
 
-	if p.Dept == 0 {
-		return http.StatusBadRequest, nil, nil, errors.New("person must belong to a department")
+	if p.Dept == 0 && p.Memberships == nil {
+		return http.StatusBadRequest, errors.New("person must belong to a department")
 	}
 
-	ctx := ql.NewRWCtx()
+	if err := validateFields(p.Fields, nil); err != nil {
+		return http.StatusBadRequest, err
+	}
 
-	rs, _, err := db.Execute(ctx, qGetDept, p.Dept)
-	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	if err := prepareContacts(p, &person{}); err != nil {
+		return http.StatusBadRequest, err
 	}
 
-	row, err := rs[0].FirstRow()
-	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	if status, err := prepareMemberships(ctx, p, &person{}, "createPerson"); err != nil {
+		return status, err
 	}
 
-	if row == nil {
-		return http.StatusNotFound, nil, nil, errors.New("department does not exist")
+	if status, err := prepareTags(ctx, p, &person{}, "createPerson"); err != nil {
+		return status, err
+	}
+
+	if err := prepareSubjects(p, &person{}); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	prepareLocation(p, &person{})
+	prepareSortName(p, &person{})
+
+	if err := prepareEmployment(p, &person{}); err != nil {
+		return http.StatusBadRequest, err
 	}
 
 	if _, _, err := db.Execute(ctx, qInsertPerson, p.Name, p.Dept, p.Email, p.Phone, p.Img, p.Role, p.Info); err != nil {
 		log.Error("failed insert into table Person", log.Ctx{"function": "createPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+		return http.StatusInternalServerError, errors.New("database insert failed")
 	}
 
 	p.ID = ctx.LastInsertID
 
-	go func() {
-		analyzer.Index(fmt.Sprintf("%v %v %v", p.Name, p.Role, p.Info), int(p.ID))
-	}()
+	if _, _, err := db.Execute(ctx, qInsertCreated, p.ID); err != nil {
+		log.Error("failed insert into table PersonCreated", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := saveFields(ctx, p.ID, p.Fields); err != nil {
+		log.Error("failed insert into table FieldValue", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonContacts(ctx, p.ID, p.Phones, p.Emails); err != nil {
+		log.Error("failed insert into table Contact", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonMemberships(ctx, p.ID, p.Memberships); err != nil {
+		log.Error("failed insert into table Membership", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonTags(ctx, p.ID, p.Tags); err != nil {
+		log.Error("failed insert into table PersonTag", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonSubjects(ctx, p.ID, p.Subjects); err != nil {
+		log.Error("failed insert into table Subject", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonLocation(ctx, p.ID, p.Location); err != nil {
+		log.Error("failed insert into table Location", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonSortName(ctx, p.ID, p.SortName); err != nil {
+		log.Error("failed insert into table PersonSortName", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if err := savePersonEmployment(ctx, p.ID, p.Employment); err != nil {
+		log.Error("failed insert into table Employment", log.Ctx{"function": "createPerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+
+	if p.Img != "" {
+		if _, err := savePersonImages(ctx, p.ID, []*personImage{{Filename: p.Img, Primary: true}}); err != nil {
+			log.Error("database query failed", log.Ctx{"function": "createPerson", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database insert failed")
+		}
+	}
 
 	log.Info("person created", log.Ctx{"ID": p.ID, "Name": p.Name, "Dept": p.Dept, "Email": p.Email, "Image": p.Img})
 
-	p.Updated = time.Now()
-	return http.StatusCreated, http.Header{
-			"Content-Location": {fmt.Sprintf(
-				"%s://%s/api/person/%d",
-				u.Scheme,
-				u.Host,
-				p.ID,
-			)},
-		},
-		p, nil
+	if updated, err := personUpdated(ctx, p.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "createPerson", "error": err.Error()})
+	} else {
+		p.Updated = updated
+	}
+	if err := setPersonDetails(ctx, p); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "createPerson", "error": err.Error()})
+	}
+
+	text := p.indexText()
+	after.add(func() {
+		updateIndex(int(p.ID), "", text)
+		emitEvent("person.created", p)
+	})
+
+	return http.StatusCreated, nil
 }
 
 // PUT /person/{id}
@@ -514,71 +1374,182 @@ func updatePerson(u *url.URL, h http.Header, p *person) (int, http.Header, *pers
 		return http.StatusBadRequest, nil, nil, errors.New("person ID must be an integer")
 	}
 
-	if p.Dept == 0 {
-		return http.StatusBadRequest, nil, nil, errors.New("person must belong to a department")
+	// If-Match is checked in the same transaction as the person is updated
+	// in, so two updates of the same version cannot both pass.
+	status, err := inTransaction("updatePerson", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		return changePerson(ctx, after, id, h, p)
+	})
+	if err != nil {
+		return status, nil, nil, err
 	}
 
-	if strings.TrimSpace(p.Name) == "" {
-		return http.StatusBadRequest, nil, nil, errors.New("person must have a name")
+	return http.StatusOK, versionHeaders(p.Updated), p, nil
+}
+
+// changePerson updates the person with the given ID, unless If-Match in h
+// doesn't match. The search index is updated and the event emitted after
+// commit. On failure it returns the HTTP status code to respond with.
+func changePerson(ctx *ql.TCtx, after *afterCommit, id int, h http.Header, p *person) (int, error) {
+	if p.Dept == 0 && p.Memberships == nil {
+		return http.StatusBadRequest, errors.New("person must belong to a department")
 	}
 
-	ctx := ql.NewRWCtx()
+	if strings.TrimSpace(p.Name) == "" {
+		return http.StatusBadRequest, errors.New("person must have a name")
+	}
 
 	// get old person, so we can unindex
 	rs, _, err := db.Execute(ctx, qGetPerson, int64(id))
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	row, err := rs[0].FirstRow()
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	if row == nil {
-		return http.StatusNotFound, nil, nil, errors.New("person not found")
+		return http.StatusNotFound, errors.New("person not found")
 	}
 
 	oldp := person{}
 	if err = ql.Unmarshal(&oldp, row); err != nil {
 		log.Error("failed to marshal db row", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
-
-	// check for existing department
-	rs, _, err = db.Execute(ctx, qGetDept, p.Dept)
-	if err != nil {
+	if err = setPersonDetails(ctx, &oldp); err != nil {
 		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
-	row, err = rs[0].FirstRow()
-	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	if !ifMatch(h, etag(oldp.Updated)) {
+		return http.StatusPreconditionFailed, errPreconditionFailed
 	}
 
-	if row == nil {
-		return http.StatusNotFound, nil, nil, errors.New("department does not exist")
+	if err := validateFields(p.Fields, oldp.Fields); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if err := prepareContacts(p, &oldp); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// check for existing departments
+	if status, err := prepareMemberships(ctx, p, &oldp, "updatePerson"); err != nil {
+		return status, err
+	}
+
+	if status, err := prepareTags(ctx, p, &oldp, "updatePerson"); err != nil {
+		return status, err
+	}
+
+	if err := prepareSubjects(p, &oldp); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	prepareLocation(p, &oldp)
+	prepareSortName(p, &oldp)
+
+	if err := prepareEmployment(p, &oldp); err != nil {
+		return http.StatusBadRequest, err
 	}
 
 	// update
 	if _, _, err := db.Execute(ctx, qUpdatePerson, p.Name, p.Dept, p.Email, p.Img, p.Role, p.Info, p.Phone, int64(id)); err != nil {
 		log.Error("database query failed", log.Ctx{"function": "updateDepartment", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	p.ID = int64(id)
+
+	if err := saveFields(ctx, p.ID, p.Fields); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonContacts(ctx, p.ID, p.Phones, p.Emails); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonMemberships(ctx, p.ID, p.Memberships); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonTags(ctx, p.ID, p.Tags); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonSubjects(ctx, p.ID, p.Subjects); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonLocation(ctx, p.ID, p.Location); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonSortName(ctx, p.ID, p.SortName); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if err := savePersonEmployment(ctx, p.ID, p.Employment); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
-	go func() {
-		analyzer.UnIndex(fmt.Sprintf("%v %v %v", oldp.Name, oldp.Role, oldp.Info), id)
-		analyzer.Index(fmt.Sprintf("%v %v %v", p.Name, p.Role, p.Info), id)
-	}()
+	if oldp.Img != p.Img {
+		// Img is the primary image; make it so in the set of images.
+		imgs, err := personImages(ctx, &oldp)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		var kept []*personImage
+		found := false
+		for _, pi := range imgs {
+			if p.Img == "" && pi.Filename == oldp.Img {
+				continue
+			}
+			pi.Primary = pi.Filename == p.Img
+			found = found || pi.Primary
+			kept = append(kept, pi)
+		}
+		if !found && p.Img != "" {
+			kept = append(kept, &personImage{Filename: p.Img, Primary: true})
+		}
+		if p.Img, err = savePersonImages(ctx, p.ID, kept); err != nil {
+			log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if len(kept) < len(imgs) {
+			releaseImage(ctx, oldp.Img)
+		}
+	}
 
 	log.Info("person updated",
 		log.Ctx{"ID": p.ID, "Name": p.Name, "Dept": p.Dept, "Email": p.Email, "Image": p.Img, "Info": p.Info, "Role": p.Role, "Phone": p.Phone})
-	p.Updated = time.Now()
-	return http.StatusOK, nil, p, nil
+	if p.Updated, err = personUpdated(ctx, p.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+	}
+	if err := setPersonDetails(ctx, p); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updatePerson", "error": err.Error()})
+	}
+
+	oldText, text := oldp.indexText(), p.indexText()
+	after.add(func() {
+		updateIndex(id, oldText, text)
+		emitEvent("person.updated", p)
+	})
+
+	return http.StatusOK, nil
 }
 
 // DELETE /person/{id}
@@ -592,87 +1563,257 @@ func deletePerson(u *url.URL, h http.Header, _ interface{}) (int, http.Header, i
 		return http.StatusBadRequest, nil, nil, errors.New("person ID must be an integer")
 	}
 
-	ctx := ql.NewRWCtx()
+	status, err := inTransaction("deletePerson", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		return removePerson(ctx, after, id, "deletePerson")
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	return http.StatusNoContent, nil, nil, nil
+}
 
+// removePerson deletes the person with the given ID, with everything
+// belonging to the person. The person is removed from the search index and
+// the event emitted after commit. On failure it returns the HTTP status code
+// to respond with.
+func removePerson(ctx *ql.TCtx, after *afterCommit, id int, function string) (int, error) {
 	// get old person, so we can unindex
 	rs, _, err := db.Execute(ctx, qGetPerson, int64(id))
 	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	row, err := rs[0].FirstRow()
 	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	if row == nil {
-		return http.StatusNotFound, nil, nil, errors.New("person not found")
+		return http.StatusNotFound, errors.New("person not found")
 	}
 
 	oldp := person{}
 	if err = ql.Unmarshal(&oldp, row); err != nil {
-		log.Error("failed to marshal db row", log.Ctx{"function": "getPerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		log.Error("failed to marshal db row", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	imgs, err := personImages(ctx, &oldp)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+	if err = setPersonDetails(ctx, &oldp); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	_, _, err = db.Execute(ctx, qDeletePerson, int64(id))
 	if err != nil {
-		log.Error("database query failed", log.Ctx{"function": "deletePerson", "error": err.Error()})
-		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
 	}
 
 	if ctx.RowsAffected == 0 {
-		return http.StatusNotFound, nil, nil, errors.New("person does not exist")
+		return http.StatusNotFound, errors.New("person does not exist")
 	}
 
 	log.Info("person deleted", log.Ctx{"ID": id})
 
-	go func() {
-		analyzer.UnIndex(fmt.Sprintf("%v %v %v", oldp.Name, oldp.Role, oldp.Info), id)
-	}()
+	if _, _, err = db.Execute(ctx, qDeletePersonImages, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	for _, pi := range imgs {
+		releaseImage(ctx, pi.Filename)
+	}
+	if _, _, err = db.Execute(ctx, qDeleteFieldValues, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteContacts, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteMemberships, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeletePersonTags, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteSubjects, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteLocation, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteAbsences, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qClearSubstitute, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteEmployment, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteCreated, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+	if _, _, err = db.Execute(ctx, qDeleteSortName, int64(id)); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+	}
+
+	oldText := oldp.indexText()
+	after.add(func() {
+		updateIndex(id, oldText, "")
+		emitEvent("person.deleted", deletedMsg{Type: "person", ID: int64(id)})
+	})
 
-	return http.StatusNoContent, nil, nil, nil
+	return http.StatusNoContent, nil
 }
 
-// GET /person
-func getAllPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*person, error) {
-	var offset, limit int
-	var err error
-	offsetStr := u.Query().Get("offset")
-	if offsetStr != "" {
-		offset, err = strconv.Atoi(offsetStr)
-		if err != nil {
-			return http.StatusBadRequest, nil, nil, errors.New("offset parameter must be an integer")
+// PUT /person/{id}/image
+//
+// setPersonImage stores an uploaded image and makes it the person's image in
+// one request. With deleteOld=true, the person's previous image is deleted,
+// unless someone else uses it.
+func setPersonImage(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("id")
+	if idStr == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing ID parameter"))
+		return
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("person ID must be an integer"))
+		return
+	}
+
+	if err := r.ParseMultipartForm(MaxMemSize); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var fileHeader *multipart.FileHeader
+	for _, fileHeaders := range r.MultipartForm.File {
+		if len(fileHeaders) > 0 {
+			fileHeader = fileHeaders[0]
+			break
 		}
 	}
+	if fileHeader == nil {
+		writeError(w, http.StatusBadRequest, errors.New("missing image file"))
+		return
+	}
 
-	limitStr := u.Query().Get("limit")
-	if limitStr == "" {
-		limit = MaxPersonsLimit
-	} else {
-		limit, err = strconv.Atoi(limitStr)
+	img, err := imageFromForm(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	ctx := ql.NewRWCtx()
+
+	p, err := fetchPerson(ctx, int64(id))
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "setPersonImage", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+
+	if p == nil {
+		writeError(w, http.StatusNotFound, errors.New("person not found"))
+		return
+	}
+
+	if status, err := storeUpload(fileHeader, img); err != nil {
+		writeError(w, status, err)
+		return
+	}
+
+	imgs, err := personImages(ctx, p)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "setPersonImage", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+
+	// The new image becomes the primary image. With deleteOld, it replaces
+	// the previous primary image in the set of images.
+	oldImg := p.Img
+	deleteOld := r.URL.Query().Get("deleteOld") == "true"
+	var kept []*personImage
+	for _, pi := range imgs {
+		if deleteOld && pi.Filename == oldImg {
+			continue
+		}
+		pi.Primary = false
+		kept = append(kept, pi)
+	}
+	kept = append(kept, &personImage{Filename: img.Filename, Primary: true})
+
+	if p.Img, err = savePersonImages(ctx, p.ID, kept); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "setPersonImage", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+	if p.Updated, err = personUpdated(ctx, p.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "setPersonImage", "error": err.Error()})
+	}
+
+	if deleteOld && oldImg != "" && oldImg != p.Img {
+		deleted := false
+		users, err := imageUsers(ctx, oldImg)
 		if err != nil {
-			return http.StatusBadRequest, nil, nil, errors.New("limit parameter must be an integer")
+			log.Error("database query failed", log.Ctx{"function": "setPersonImage", "error": err.Error()})
+		} else if len(users) == 0 {
+			if err := removeImage(ctx, oldImg); err != nil {
+				log.Error("failed to delete file", log.Ctx{"function": "setPersonImage", "filename": oldImg, "error": err.Error()})
+			} else {
+				deleted = true
+				log.Info("image deleted", log.Ctx{"filename": oldImg})
+			}
+		}
+		if !deleted {
+			releaseImage(ctx, oldImg)
 		}
 	}
 
-	ctx := ql.NewRWCtx()
-	rs, _, err := db.Execute(ctx, qGetAllPersons, int64(offset), int64(limit))
+	log.Info("person image updated", log.Ctx{"ID": p.ID, "Image": p.Img, "OldImage": oldImg})
+
+	if err := setPersonDetails(ctx, p); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "setPersonImage", "error": err.Error()})
+	}
+	emitEvent("person.updated", p)
+	writeJSON(w, http.StatusOK, p)
+}
+
+// GET /person
+func getAllPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*person, error) {
+	ctx := readCtx
+	filter, status, err := filterParams(ctx, u, "getAllPersons")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	// The page is taken after filtering and sorting; only its persons get
+	// their details.
+	rs, _, err := db.Execute(ctx, qAllPersons)
 	if err != nil {
 		log.Error("database query failed", log.Ctx{"function": "getAllPersons", "error": err.Error()})
 		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
 	}
 
-	var persons []*person
+	persons := []*person{}
 	for _, rs := range rs {
 		if err := rs.Do(false, func(data []interface{}) (bool, error) {
 			p := &person{}
 			if err := ql.Unmarshal(p, data); err != nil {
 				return false, err
 			}
-			persons = append(persons, p)
+			if filter.matches(p) {
+				persons = append(persons, p)
+			}
 			return true, nil
 		}); err != nil {
 			log.Error("failed to unmarshal persons", log.Ctx{"function": "getAllPersons", "error": err.Error()})
@@ -680,12 +1821,41 @@ func getAllPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header,
 		}
 	}
 
+	l, status, err := sortPersons(ctx, u, persons, "-id", "getAllPersons")
+	if err != nil {
+		return status, nil, nil, err
+	}
+	from, to, header, err := l.page(u, MaxPersonsLimit)
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	persons = persons[from:to]
+
 	order := u.Query().Get("order")
 	if order == "random" {
 		shufflePersons(persons)
 	}
 
-	return http.StatusOK, nil, persons, nil
+	if err := setPersonDetails(ctx, persons...); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getAllPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if !showInternal(u) {
+		hideInternal(persons...)
+	}
+
+	return http.StatusOK, header, persons, nil
+}
+
+// filterHits returns the hits which are in ids.
+func filterHits(hits []int, ids map[int64]bool) []int {
+	res := []int{}
+	for _, id := range hits {
+		if ids[int64(id)] {
+			res = append(res, id)
+		}
+	}
+	return res
 }
 
 // GET /search
@@ -694,14 +1864,89 @@ func searchPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header,
 	res := &searchResults{}
 	t0 := time.Now()
 	q := u.Query().Get("q")
-	parsedQuery := strings.Split(strings.ToLower(q), " ")
+	tags := u.Query()["tag"]
+	ctx := readCtx
+
+	if strings.TrimSpace(q) == "" && len(tags) > 0 {
+		// Only searching by tags; start with everyone with the first tag.
+		tagged, err := taggedPersons(ctx, tags[0])
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "searchPersons", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		for id := range tagged {
+			res.Hits = append(res.Hits, int(id))
+		}
+		sort.Ints(res.Hits)
+	} else {
+		parsedQuery := strings.Split(strings.ToLower(q), " ")
+
+		query := index.NewQuery().Must(parsedQuery)
+		analyzerMu.RLock()
+		hits := analyzer.Idx.Query(query)
+		hitsSet := srAsIntSet(hits)
+		res.Hits = hitsSet.All()
+		analyzerMu.RUnlock()
+	}
+
+	// Only persons with all the given tags
+	for _, t := range tags {
+		tagged, err := taggedPersons(ctx, t)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "searchPersons", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		res.Hits = filterHits(res.Hits, tagged)
+	}
+
+	// Only persons in the given department, or its subdepartments
+	if deptStr := u.Query().Get("dept"); deptStr != "" {
+		dept, err := strconv.Atoi(deptStr)
+		if err != nil {
+			return http.StatusBadRequest, nil, nil, errors.New("dept parameter must be an integer")
+		}
+		members, err := deptMembers(ctx, int64(dept))
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "searchPersons", "error": err.Error()})
+			return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+		}
+		res.Hits = filterHits(res.Hits, members)
+	}
+
+	// Only persons at the given location
+	located, err := locatedPersons(ctx, u)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "searchPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if located != nil {
+		res.Hits = filterHits(res.Hits, located)
+	}
 
-	query := index.NewQuery().Must(parsedQuery)
-	hits := analyzer.Idx.Query(query)
-	hitsSet := srAsIntSet(hits)
-	res.Count = hitsSet.Size()
-	res.Hits = hitsSet.All()
+	// Only persons who are employed, unless asked for
+	inactive, err := inactivePersons(ctx, u)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "searchPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	res.Hits = excludeHits(res.Hits, inactive)
+	res.Count = len(res.Hits)
+
+	l := &listing{
+		order: "id",
+		keys:  make([]string, len(res.Hits)),
+		swap:  func(i, j int) { res.Hits[i], res.Hits[j] = res.Hits[j], res.Hits[i] },
+	}
+	for i, id := range res.Hits {
+		l.keys[i] = idKey(int64(id))
+	}
+	sort.Sort(l)
+	from, to, header, err := l.page(u, -1)
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	res.Hits = res.Hits[from:to]
 	res.TookMs = float64(time.Now().Sub(t0)) / 1000000
 
-	return http.StatusOK, nil, res, nil
+	return http.StatusOK, header, res, nil
 }
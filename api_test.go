@@ -1,11 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/cznic/ql"
 	"github.com/knakk/ftx"
@@ -16,8 +28,13 @@ import (
 var testMux = tigertonic.NewHostServeMux()
 
 func init() {
-	var err error
-	db, err = ql.OpenMem()
+	// A file DB, as the in-memory DB doesn't roll back nested transactions.
+	dbDir, err := ioutil.TempDir("", "folk-db")
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+	db, err = ql.OpenFile(filepath.Join(dbDir, "test.db"), &ql.Options{CanCreate: true})
 	if err != nil {
 		println(err.Error())
 		os.Exit(1)
@@ -34,7 +51,7 @@ func init() {
 		INSERT INTO Department VALUES ("subA1", 2), ("subA2", 2), ("subB1", 1);
 		INSERT INTO Person VALUES ("Mr. A", 4, "a@com", "", "a.png", "", "", now());
 		INSERT INTO Person VALUES ("Mr. B", 4, "b@com", "", "b.png", "", "", now());
-		INSERT INTO Person VALUES ("Mr. C", 5, "c@com", "", "c.png", "", "", now());
+		INSERT INTO Person VALUES ("Mr. C", 5, "c@com", "22 03 29 00 / 98765432", "c.png", "", "", now());
 	COMMIT;
 	`)
 
@@ -44,8 +61,28 @@ func init() {
 		os.Exit(1)
 	}
 
+	if _, err := migrateContacts(); err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+	if _, err := migrateMemberships(); err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+	if _, err := migrateCreated(); err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+
 	analyzer = ftx.NewNGramAnalyzer(1, 20)
 
+	imgDir, err := ioutil.TempDir("", "folk-img")
+	if err != nil {
+		println(err.Error())
+		os.Exit(1)
+	}
+	imgStore = fileImageStore{dir: imgDir}
+
 	setupAPIRouting()
 	nsMux := tigertonic.NewTrieServeMux()
 	nsMux.HandleNamespace("/api", apiMux)
@@ -227,6 +264,17 @@ func TestUpdateDepartment(t *testing.T) {
 	if response.Name != "mainA+" || response.ID != 1 {
 		t.Errorf("updateDepartment should return update response, got %+v", response)
 	}
+
+	for _, parent := range []int64{1, 6} {
+		status, _, _, _ = updateDepartment(
+			mocking.URL(testMux, "PUT", "http://test.com/api/department/1"),
+			mocking.Header(nil),
+			&department{Name: "mainA+", Parent: parent},
+		)
+		if status != http.StatusBadRequest {
+			t.Errorf("moving a department below itself, to %d: want %d, got %d", parent, http.StatusBadRequest, status)
+		}
+	}
 }
 
 func TestCreateAndGetPerson(t *testing.T) {
@@ -418,3 +466,2057 @@ func TestGetAllPersons(t *testing.T) {
 	}
 
 }
+
+func TestImageUsageAndCollect(t *testing.T) {
+	for _, f := range []string{"a.png", "unused.png"} {
+		if err := imgStore.Put(f, strings.NewReader(f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().AddDate(0, 0, -10)
+	for _, f := range []string{"a.png", "unused.png"} {
+		if err := os.Chtimes(filepath.Join(imgStore.(fileImageStore).dir, f), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadImages(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _, usage, err := getImageUsage(
+		mocking.URL(testMux, "GET", "http://test.com/api/images/usage"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if err != nil {
+		t.Fatalf("getImageUsage should succeed, got error: %v", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("want => %v, got %v", http.StatusOK, status)
+	}
+
+	if !reflect.DeepEqual(usage["a.png"], []int64{7}) || len(usage["unused.png"]) != 0 {
+		t.Errorf("getImageUsage returned wrong usage: %v", usage)
+	}
+
+	status, _, report, err := collectImages(
+		mocking.URL(testMux, "POST", "http://test.com/api/images/gc?days=5"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if err != nil {
+		t.Fatalf("collectImages should succeed, got error: %v", err)
+	}
+
+	if !report.DryRun || len(report.Unused) != 1 || report.Unused[0].Filename != "unused.png" || len(report.Removed) != 0 {
+		t.Errorf("collectImages dry run returned wrong report: %+v", report)
+	}
+
+	status, _, report, err = collectImages(
+		mocking.URL(testMux, "POST", "http://test.com/api/images/gc?days=5&dryrun=false"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if err != nil {
+		t.Fatalf("collectImages should succeed, got error: %v", err)
+	}
+
+	if !reflect.DeepEqual(report.Removed, []string{"unused.png"}) {
+		t.Errorf("collectImages should remove unused image, got report: %+v", report)
+	}
+
+	if _, err := imgStore.Get("unused.png"); err != errImageNotFound {
+		t.Errorf("collected image should be deleted from image store")
+	}
+
+	status, _, _, err = collectImages(
+		mocking.URL(testMux, "POST", "http://test.com/api/images/gc"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if status != http.StatusBadRequest {
+		t.Errorf("collectImages without days parameter: want %v, got %v", http.StatusBadRequest, status)
+	}
+}
+
+func TestImageMetadata(t *testing.T) {
+	if err := imgStore.Put("meta.png", strings.NewReader("meta")); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadImages(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _, _, err := updateImage(
+		mocking.URL(testMux, "PUT", "http://test.com/api/image/meta.png"),
+		mocking.Header(nil),
+		&image{Alt: "Portrait", Consent: "maybe"},
+	)
+
+	if status != http.StatusBadRequest {
+		t.Errorf("updateImage with invalid consent: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	status, _, _, err = updateImage(
+		mocking.URL(testMux, "PUT", "http://test.com/api/image/meta.png"),
+		mocking.Header(nil),
+		&image{Alt: "Portrait of Mr. M", Photographer: "Ms. P", Licence: "CC BY 4.0", Consent: "given"},
+	)
+
+	if err != nil {
+		t.Fatalf("updateImage should succeed, got error: %v", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("want => %v, got %v", http.StatusOK, status)
+	}
+
+	// Metadata is persisted, not only cached.
+	if err := loadImages(); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _, img, err := getImage(
+		mocking.URL(testMux, "GET", "http://test.com/api/image/meta.png"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if err != nil {
+		t.Fatalf("getImage should succeed, got error: %v", err)
+	}
+
+	if img.Alt != "Portrait of Mr. M" || img.Photographer != "Ms. P" || img.Licence != "CC BY 4.0" || img.Consent != "given" {
+		t.Errorf("getImage returned wrong metadata: %+v", img)
+	}
+
+	status, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. M", Dept: 4, Img: "meta.png"},
+	)
+
+	if err != nil {
+		t.Fatalf("createPerson should succeed, got error: %v", err)
+	}
+
+	if p.ImgAlt != "Portrait of Mr. M" {
+		t.Errorf("person should have the alternative text of its image, got %q", p.ImgAlt)
+	}
+}
+
+func TestAvatar(t *testing.T) {
+	if initials("Åse Marie Nilsen") != "ÅN" || initials("Kari") != "K" || initials("") != "?" {
+		t.Errorf("wrong initials")
+	}
+
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Ole Brumm", Dept: 4},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", mocking.URL(testMux, "GET", url).String(), nil)
+		avatarHandler(w, r)
+		return w
+	}
+
+	w := get(fmt.Sprintf("http://test.com/api/person/%d/avatar", p.ID))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("avatar of person without image: want SVG, got %d %v", w.Code, w.Header())
+	}
+	if !strings.Contains(w.Body.String(), ">OB</text>") || !strings.Contains(w.Body.String(), avatarColor(p.ID)) {
+		t.Errorf("avatar should have initials and color derived from ID, got %s", w.Body.String())
+	}
+	if w2 := get(fmt.Sprintf("http://test.com/api/person/%d/avatar", p.ID)); w2.Body.String() != w.Body.String() {
+		t.Errorf("avatar should be deterministic")
+	}
+
+	if w := get(fmt.Sprintf("http://test.com/api/person/%d/avatar?color=dept", p.ID)); !strings.Contains(w.Body.String(), avatarColor(4)) {
+		t.Errorf("avatar should have color derived from department, got %s", w.Body.String())
+	}
+
+	if err := imgStore.Put("avatar.png", strings.NewReader("avatar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadImages(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, p, err = createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Nasse Nøff", Dept: 4, Img: "avatar.png"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = get(fmt.Sprintf("http://test.com/api/person/%d/avatar", p.ID))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/img/avatar.png" {
+		t.Errorf("avatar of person with image should redirect to image, got %d %v", w.Code, w.Header())
+	}
+
+	if w := get("http://test.com/api/person/9999/avatar"); w.Code != http.StatusNotFound {
+		t.Errorf("want => %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSetPersonImage(t *testing.T) {
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. Photo", Dept: 4},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(url, filename string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("image", filename)
+		fw.Write([]byte(filename))
+		mw.WriteField("alt", "Photo of Mr. Photo")
+		mw.Close()
+		r, _ := http.NewRequest("PUT", mocking.URL(testMux, "PUT", url).String(), &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		setPersonImage(w, r)
+		return w
+	}
+
+	w := upload(fmt.Sprintf("http://test.com/api/person/%d/image", p.ID), "photo1.png")
+	if w.Code != http.StatusOK {
+		t.Fatalf("setPersonImage should succeed, got %d %s", w.Code, w.Body.String())
+	}
+	var res person
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Img != "photo1.png" || res.ImgAlt != "Photo of Mr. Photo" {
+		t.Errorf("setPersonImage should return person with new image, got %+v", res)
+	}
+
+	w = upload(fmt.Sprintf("http://test.com/api/person/%d/image", p.ID), "photo1.png")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("uploading existing image name: want %v, got %v", http.StatusBadRequest, w.Code)
+	}
+
+	w = upload(fmt.Sprintf("http://test.com/api/person/%d/image?deleteOld=true", p.ID), "photo2.png")
+	if w.Code != http.StatusOK {
+		t.Fatalf("setPersonImage should succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := imgStore.Get("photo1.png"); err != errImageNotFound {
+		t.Errorf("previous image should be deleted when deleteOld=true")
+	}
+
+	ctx := ql.NewRWCtx()
+	stored, err := fetchPerson(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Img != "photo2.png" {
+		t.Errorf("person image should be stored, got %q", stored.Img)
+	}
+
+	// Don't delete previous image if someone else uses it.
+	_, _, _, err = createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. Photo's twin", Dept: 4, Img: "photo2.png"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = upload(fmt.Sprintf("http://test.com/api/person/%d/image?deleteOld=true", p.ID), "photo3.png")
+	if w.Code != http.StatusOK {
+		t.Fatalf("setPersonImage should succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := imgStore.Get("photo2.png"); err != nil {
+		t.Errorf("previous image should be kept when used by someone else, got %v", err)
+	}
+
+	if w := upload("http://test.com/api/person/9999/image", "photo4.png"); w.Code != http.StatusNotFound {
+		t.Errorf("want => %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestPersonImages(t *testing.T) {
+	for _, f := range []string{"formal.png", "casual.png"} {
+		if err := imgStore.Put(f, strings.NewReader(f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := loadImages(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. Portrait", Dept: 4, Img: "formal.png"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(p.Images) != 1 || p.Images[0].Filename != "formal.png" || !p.Images[0].Primary {
+		t.Fatalf("person should have its image as primary image, got %+v", p.Images)
+	}
+
+	imagesURL := fmt.Sprintf("http://test.com/api/person/%d/images", p.ID)
+	status, _, imgs, err := addPersonImage(
+		mocking.URL(testMux, "POST", imagesURL),
+		mocking.Header(nil),
+		&personImage{Filename: "casual.png", Label: "casual"},
+	)
+
+	if err != nil {
+		t.Fatalf("addPersonImage should succeed, got error: %v", err)
+	}
+
+	if status != http.StatusCreated {
+		t.Errorf("want => %v, got %v", http.StatusCreated, status)
+	}
+
+	if len(imgs) != 2 || imgs[1].Filename != "casual.png" || imgs[1].Primary {
+		t.Errorf("addPersonImage should add non-primary image last, got %+v", imgs)
+	}
+
+	status, _, _, err = addPersonImage(
+		mocking.URL(testMux, "POST", imagesURL),
+		mocking.Header(nil),
+		&personImage{Filename: "nope.png"},
+	)
+
+	if status != http.StatusBadRequest {
+		t.Errorf("adding non-existing image: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	status, _, imgs, err = reorderPersonImages(
+		mocking.URL(testMux, "PUT", imagesURL),
+		mocking.Header(nil),
+		&imageOrder{Order: []string{"casual.png", "formal.png"}, Primary: "casual.png"},
+	)
+
+	if err != nil {
+		t.Fatalf("reorderPersonImages should succeed, got error: %v", err)
+	}
+
+	if imgs[0].Filename != "casual.png" || !imgs[0].Primary || imgs[1].Primary {
+		t.Errorf("reorderPersonImages should reorder and set primary, got %+v", imgs)
+	}
+
+	status, _, got, err := getPerson(
+		mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", p.ID)),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Img != "casual.png" || len(got.Images) != 2 {
+		t.Errorf("person's Img should be the primary image, got %+v", got)
+	}
+
+	// A non-primary image is still in use.
+	status, _, _, err = deleteImage(
+		mocking.URL(testMux, "DELETE", "http://test.com/api/image/formal.png"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if err == nil || err.Error() != "image is in use; cannot delete" {
+		t.Errorf("deleteImage should not delete images in a person's set of images, got %v", err)
+	}
+
+	status, _, _, err = removePersonImage(
+		mocking.URL(testMux, "DELETE", imagesURL+"/casual.png"),
+		mocking.Header(nil),
+		nil,
+	)
+
+	if status != http.StatusNoContent {
+		t.Fatalf("want => %v, got %v (%v)", http.StatusNoContent, status, err)
+	}
+
+	ctx := ql.NewRWCtx()
+	stored, err := fetchPerson(ctx, p.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Img != "formal.png" {
+		t.Errorf("removing the primary image should make the next image primary, got %q", stored.Img)
+	}
+}
+
+func TestCustomFields(t *testing.T) {
+	defs := []*fieldDef{
+		{Name: "contract", Type: FieldEnum, Options: []string{"fixed", "temporary"}, Required: true},
+		{Name: "nickname", Type: FieldText, Public: true, Indexed: true},
+		{Name: "started", Type: "number"},
+	}
+	for i, d := range defs {
+		status, _, _, err := createFieldDef(
+			mocking.URL(testMux, "POST", "http://test.com/api/field"),
+			mocking.Header(nil),
+			d,
+		)
+		if i == 2 {
+			if status != http.StatusBadRequest {
+				t.Errorf("creating field with unknown type: want %v, got %v", http.StatusBadRequest, status)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("createFieldDef should succeed, got error: %v", err)
+		}
+		defer deleteFieldDef(
+			mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/field/%d", d.ID)),
+			mocking.Header(nil),
+			nil,
+		)
+	}
+
+	tests := []struct {
+		fields map[string]string
+		status int
+	}{
+		{map[string]string{"nickname": "Zorro"}, http.StatusBadRequest},
+		{map[string]string{"contract": "forever"}, http.StatusBadRequest},
+		{map[string]string{"contract": "fixed", "shoesize": "42"}, http.StatusBadRequest},
+		{map[string]string{"contract": "fixed", "nickname": "Zorro"}, http.StatusCreated},
+	}
+
+	var p *person
+	for _, test := range tests {
+		status, _, res, _ := createPerson(
+			mocking.URL(testMux, "POST", "http://test.com/api/person"),
+			mocking.Header(nil),
+			&person{Name: "Mr. Custom", Dept: 4, Fields: test.fields},
+		)
+		if status != test.status {
+			t.Errorf("createPerson with fields %v: want %v, got %v", test.fields, test.status, status)
+		}
+		if status == http.StatusCreated {
+			p = res
+		}
+	}
+	if p == nil {
+		t.Fatal("person with valid fields not created")
+	}
+
+	personURL := fmt.Sprintf("http://test.com/api/person/%d", p.ID)
+	_, _, p, err := getPerson(mocking.URL(testMux, "GET", personURL), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"nickname": "Zorro"}; !reflect.DeepEqual(p.Fields, want) {
+		t.Errorf("public fields: want %v, got %v", want, p.Fields)
+	}
+
+	_, _, p, err = getPerson(mocking.URL(testMux, "GET", personURL+"?internal=true"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"contract": "fixed", "nickname": "Zorro"}; !reflect.DeepEqual(p.Fields, want) {
+		t.Errorf("internal fields: want %v, got %v", want, p.Fields)
+	}
+
+	if text := p.indexText(); !strings.Contains(text, "Zorro") || strings.Contains(text, "fixed") {
+		t.Errorf("index text should contain indexed fields only, got %q", text)
+	}
+
+	p.Fields = map[string]string{"nickname": ""}
+	_, _, p, err = updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p)
+	if err != nil {
+		t.Fatalf("updatePerson should succeed, got error: %v", err)
+	}
+	if want := map[string]string{"contract": "fixed"}; !reflect.DeepEqual(p.Fields, want) {
+		t.Errorf("after clearing nickname: want %v, got %v", want, p.Fields)
+	}
+
+	p.Fields = map[string]string{"contract": ""}
+	status, _, _, _ := updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p)
+	if status != http.StatusBadRequest {
+		t.Errorf("clearing required field: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	// Values from before the fields were changed don't stop other updates.
+	contract := &fieldDef{Name: "contract", Type: FieldEnum, Options: []string{"permanent", "temporary"}, Required: true}
+	nickname := &fieldDef{Name: "nickname", Type: FieldText, Public: true, Indexed: true, Required: true}
+	for _, d := range []*fieldDef{contract, nickname} {
+		if _, _, _, err := updateFieldDef(mocking.URL(testMux, "PUT", fmt.Sprintf("http://test.com/api/field/%d", fields.byName(d.Name).ID)), mocking.Header(nil), d); err != nil {
+			t.Fatalf("updateFieldDef should succeed, got error: %v", err)
+		}
+	}
+	p.Fields = map[string]string{"contract": "fixed"}
+	p.Role = "Custom role"
+	if status, _, _, err := updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p); status != http.StatusOK {
+		t.Errorf("updating person with values from before the fields changed: want %v, got %v %v", http.StatusOK, status, err)
+	}
+	p.Fields = map[string]string{"contract": "fixed", "nickname": ""}
+	if status, _, _, _ := updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p); status != http.StatusOK {
+		t.Errorf("sending back a missing required value: want %v, got %v", http.StatusOK, status)
+	}
+	p.Fields = map[string]string{"contract": "temporary"}
+	if status, _, _, _ := updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p); status != http.StatusOK {
+		t.Errorf("changing a value: want %v, got %v", http.StatusOK, status)
+	}
+	p.Fields = map[string]string{"contract": "fixed"}
+	if status, _, _, _ := updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p); status != http.StatusBadRequest {
+		t.Errorf("changing to a value no longer allowed: want %v, got %v", http.StatusBadRequest, status)
+	}
+	status, _, _, _ = createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil),
+		&person{Name: "Mr. Nameless", Dept: 4, Fields: map[string]string{"contract": "temporary"}})
+	if status != http.StatusBadRequest {
+		t.Errorf("creating person without field made required: want %v, got %v", http.StatusBadRequest, status)
+	}
+}
+
+func TestContacts(t *testing.T) {
+	// Mr. C had two phone numbers in Phone, separated by a slash.
+	_, _, p, err := getPerson(mocking.URL(testMux, "GET", "http://test.com/api/person/9"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Phones) != 2 ||
+		p.Phones[0].Value != "22 03 29 00" || p.Phones[0].Kind != ContactDesk || !p.Phones[0].Preferred ||
+		p.Phones[1].Value != "98765432" || p.Phones[1].Kind != ContactMobile || p.Phones[1].Preferred {
+		t.Errorf("migrated phone numbers: got %+v %+v", p.Phones[0], p.Phones[1])
+	}
+	if p.Phone != "22 03 29 00" {
+		t.Errorf("Phone should be the preferred phone number, got %q", p.Phone)
+	}
+	if len(p.Emails) != 1 || p.Emails[0].Value != "c@com" || p.Emails[0].Kind != ContactWork {
+		t.Errorf("migrated email addresses: got %+v", p.Emails)
+	}
+
+	status, _, _, _ := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Ms. Reachable", Dept: 4, Phones: []*contact{{Kind: "fax", Value: "12345678"}}},
+	)
+	if status != http.StatusBadRequest {
+		t.Errorf("phone with unknown kind: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	_, _, p, err = createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{
+			Name: "Ms. Reachable",
+			Dept: 4,
+			Phones: []*contact{
+				{Kind: ContactMobile, Value: "+47 987 65 432", Preferred: true},
+				{Kind: ContactDesk, Value: "23 43 29 00", Public: true},
+			},
+			Emails: []*contact{
+				{Kind: ContactShared, Value: "info@com", Public: true},
+				{Kind: ContactWork, Value: "ms.r@com", Public: true, Preferred: true},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("createPerson should succeed, got error: %v", err)
+	}
+	if p.Phone != "+47 987 65 432" || p.Email != "ms.r@com" {
+		t.Errorf("Phone and Email should be the preferred ones, got %q and %q", p.Phone, p.Email)
+	}
+
+	personURL := fmt.Sprintf("http://test.com/api/person/%d", p.ID)
+	_, _, p, err = getPerson(mocking.URL(testMux, "GET", personURL), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Phones) != 1 || p.Phone != "23 43 29 00" {
+		t.Errorf("internal phone numbers should be hidden, got %q %+v", p.Phone, p.Phones)
+	}
+
+	// A client which only knows Phone replaces the preferred phone number.
+	_, _, p, err = getPerson(mocking.URL(testMux, "GET", personURL+"?internal=true"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Phones, p.Emails = nil, nil
+	p.Phone = "41 00 00 00"
+	_, _, p, err = updatePerson(mocking.URL(testMux, "PUT", personURL), mocking.Header(nil), p)
+	if err != nil {
+		t.Fatalf("updatePerson should succeed, got error: %v", err)
+	}
+	if len(p.Phones) != 2 || p.Phones[0].Value != "41 00 00 00" || !p.Phones[0].Preferred || p.Phones[1].Value != "23 43 29 00" {
+		t.Errorf("after changing Phone: got %+v", p.Phones)
+	}
+	if len(p.Emails) != 2 || p.Email != "ms.r@com" {
+		t.Errorf("email addresses should be unchanged, got %q %+v", p.Email, p.Emails)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://test.com/api/export/persons.csv", nil)
+	exportPersons(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("exportPersons: want %v, got %v", http.StatusOK, w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "info@com (shared)") {
+		t.Errorf("export should contain public email addresses, got %s", w.Body.String())
+	}
+}
+
+func TestMemberships(t *testing.T) {
+	tests := []struct {
+		ms     []*membership
+		status int
+	}{
+		{[]*membership{}, http.StatusBadRequest},
+		{[]*membership{{Dept: 4}, {Dept: 4}}, http.StatusBadRequest},
+		{[]*membership{{Dept: 4, Primary: true}, {Dept: 5, Primary: true}}, http.StatusBadRequest},
+		{[]*membership{{Dept: 4, Percent: 101}}, http.StatusBadRequest},
+		{[]*membership{{Dept: 4}, {Dept: 999}}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		status, _, _, _ := createPerson(
+			mocking.URL(testMux, "POST", "http://test.com/api/person"),
+			mocking.Header(nil),
+			&person{Name: "Ms. Split", Memberships: test.ms},
+		)
+		if status != test.status {
+			t.Errorf("createPerson with memberships %v: want %v, got %v", test.ms, test.status, status)
+		}
+	}
+
+	_, _, d, err := createDepartment(
+		mocking.URL(testMux, "POST", "http://test.com/api/department"),
+		mocking.Header(nil),
+		&department{Name: "Branch X", Parent: 0},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Ms. Split", Memberships: []*membership{
+			{Dept: 4, Role: "librarian", Percent: 60},
+			{Dept: d.ID, Role: "coordinator", Percent: 40, Primary: true},
+		}},
+	)
+	if err != nil {
+		t.Fatalf("createPerson should succeed, got error: %v", err)
+	}
+	if p.Dept != d.ID || p.Role != "coordinator" {
+		t.Errorf("Dept and Role should be the primary ones, got %d and %q", p.Dept, p.Role)
+	}
+	if len(p.Memberships) != 2 || !p.Memberships[0].Primary {
+		t.Errorf("primary membership should be listed first, got %+v", p.Memberships)
+	}
+
+	members, err := deptMembers(ql.NewRWCtx(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !members[p.ID] || !members[7] || !members[8] || !members[9] {
+		t.Errorf("members of department 2 and its subdepartments: got %v", members)
+	}
+
+	// A client which only knows Dept and Role replaces the primary membership.
+	p.Memberships = nil
+	p.Dept, p.Role = 6, "head"
+	_, _, p, err = updatePerson(
+		mocking.URL(testMux, "PUT", fmt.Sprintf("http://test.com/api/person/%d", p.ID)),
+		mocking.Header(nil),
+		p,
+	)
+	if err != nil {
+		t.Fatalf("updatePerson should succeed, got error: %v", err)
+	}
+	if len(p.Memberships) != 2 ||
+		p.Memberships[0].Dept != 6 || p.Memberships[0].Role != "head" || !p.Memberships[0].Primary ||
+		p.Memberships[1].Dept != 4 || p.Memberships[1].Role != "librarian" {
+		t.Errorf("after changing Dept and Role: got %+v %+v", p.Memberships[0], p.Memberships[1])
+	}
+
+	// The new department is empty now.
+	status, _, _, err := deleteDepartment(
+		mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/department/%d", d.ID)),
+		mocking.Header(nil),
+		nil,
+	)
+	if status != http.StatusNoContent {
+		t.Errorf("deleteDepartment without members: want %v, got %v (%v)", http.StatusNoContent, status, err)
+	}
+
+	status, _, _, err = deleteDepartment(
+		mocking.URL(testMux, "DELETE", "http://test.com/api/department/6"),
+		mocking.Header(nil),
+		nil,
+	)
+	if status != http.StatusBadRequest {
+		t.Errorf("deleteDepartment with members: want %v, got %v", http.StatusBadRequest, status)
+	}
+}
+
+func TestTags(t *testing.T) {
+	tags := []struct {
+		t      *tag
+		status int
+	}{
+		{&tag{Name: "Arabic", Kind: TagLanguage}, http.StatusCreated},
+		{&tag{Name: "Persian", Kind: TagLanguage}, http.StatusCreated},
+		{&tag{Name: "genealogy", Kind: TagSubject}, http.StatusCreated},
+		{&tag{Name: "arabic", Kind: TagLanguage}, http.StatusBadRequest},
+		{&tag{Name: "juggling", Kind: "hobby"}, http.StatusBadRequest},
+		{&tag{Name: "a/b", Kind: TagSkill}, http.StatusBadRequest},
+	}
+	for _, test := range tags {
+		status, _, _, _ := createTag(
+			mocking.URL(testMux, "POST", "http://test.com/api/tags"),
+			mocking.Header(nil),
+			test.t,
+		)
+		if status != test.status {
+			t.Errorf("createTag %+v: want %v, got %v", test.t, test.status, status)
+		}
+	}
+
+	status, _, _, _ := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. Unknown", Dept: 4, Tags: []string{"klingon"}},
+	)
+	if status != http.StatusBadRequest {
+		t.Errorf("createPerson with unknown tag: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Ms. Polyglot", Dept: 4, Tags: []string{"arabic", "Persian", "Genealogy"}},
+	)
+	if err != nil {
+		t.Fatalf("createPerson should succeed, got error: %v", err)
+	}
+	if want := []string{"Arabic", "Persian", "genealogy"}; !reflect.DeepEqual(p.Tags, want) {
+		t.Errorf("tags should be normalized, want %v, got %v", want, p.Tags)
+	}
+
+	_, _, all, err := getTags(mocking.URL(testMux, "GET", "http://test.com/api/tags?kind=language"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Name != "Arabic" || all[0].Count != 1 {
+		t.Errorf("getTags?kind=language: got %v", all)
+	}
+
+	_, _, persons, err := getTagPersons(mocking.URL(testMux, "GET", "http://test.com/api/tags/ARABIC/persons"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 1 || persons[0].ID != p.ID {
+		t.Errorf("getTagPersons: want person %d, got %v", p.ID, persons)
+	}
+
+	_, _, res, err := searchPersons(mocking.URL(testMux, "GET", "http://test.com/api/search?tag=genealogy&tag=arabic"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 1 || res.Hits[0] != int(p.ID) {
+		t.Errorf("searching by tags: want person %d, got %v", p.ID, res.Hits)
+	}
+
+	status, _, _, err = mergeTag(mocking.URL(testMux, "POST", "http://test.com/api/tags/Arabic/merge-into/Persian"), mocking.Header(nil), nil)
+	if status != http.StatusOK {
+		t.Fatalf("mergeTag: want %v, got %v (%v)", http.StatusOK, status, err)
+	}
+
+	_, _, updated, err := updateTag(mocking.URL(testMux, "PUT", "http://test.com/api/tags/Persian"), mocking.Header(nil), &tag{Name: "Farsi", Kind: TagLanguage})
+	if err != nil {
+		t.Fatalf("updateTag should succeed, got error: %v", err)
+	}
+	if updated.Name != "Farsi" {
+		t.Errorf("renamed tag: got %v", updated)
+	}
+
+	_, _, p, err = getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Farsi", "genealogy"}; !reflect.DeepEqual(p.Tags, want) {
+		t.Errorf("after merging and renaming: want %v, got %v", want, p.Tags)
+	}
+
+	for _, name := range []string{"Farsi", "genealogy"} {
+		status, _, _, _ = deleteTag(mocking.URL(testMux, "DELETE", "http://test.com/api/tags/"+name), mocking.Header(nil), nil)
+		if status != http.StatusNoContent {
+			t.Errorf("deleteTag %s: want %v, got %v", name, http.StatusNoContent, status)
+		}
+	}
+}
+
+func TestSubjects(t *testing.T) {
+	status, _, _, _ := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. Backwards", Dept: 4, Subjects: []*subject{{Low: "999", High: "900"}}},
+	)
+	if status != http.StatusBadRequest {
+		t.Errorf("createPerson with reversed Dewey range: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	specialists := []*person{
+		{Name: "Ms. History", Dept: 4, Subjects: []*subject{{Low: "900", High: "999", Label: "History"}}},
+		{Name: "Mr. Europe", Dept: 4, Subjects: []*subject{{Low: "940", High: "949.9", Label: "History of Europe"}}},
+		{Name: "Ms. Nordic", Dept: 4, Subjects: []*subject{{Low: "947", High: "948", Label: "Nordic history"}}},
+		// Single numbers of different precision
+		{Name: "Anne Russia", Dept: 4, Subjects: []*subject{{Low: "947"}}},
+		{Name: "Mr. Exact", Dept: 4, Subjects: []*subject{{Low: "947.5"}}},
+		// Equal ranges, sorted by name in Norwegian order
+		{Name: "Frank Sport", Dept: 4, Subjects: []*subject{{Low: "796"}}},
+		{Name: "Émile Sport", Dept: 4, Subjects: []*subject{{Low: "796"}}},
+	}
+	for _, sp := range specialists {
+		_, _, p, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), sp)
+		if err != nil {
+			t.Fatalf("createPerson should succeed, got error: %v", err)
+		}
+		sp.ID = p.ID
+	}
+
+	tests := []struct {
+		ddc  string
+		want []int64
+	}{
+		{"947.5", []int64{specialists[4].ID, specialists[3].ID, specialists[2].ID, specialists[1].ID, specialists[0].ID}},
+		{"947.1", []int64{specialists[3].ID, specialists[2].ID, specialists[1].ID, specialists[0].ID}},
+		{"948.99", []int64{specialists[2].ID, specialists[1].ID, specialists[0].ID}},
+		{"950.1", []int64{specialists[0].ID}},
+		{"999.9", []int64{specialists[0].ID}},
+		{"796", []int64{specialists[6].ID, specialists[5].ID}},
+		{"100", []int64{}},
+	}
+	for _, test := range tests {
+		_, _, hits, err := getSubject(mocking.URL(testMux, "GET", "http://test.com/api/subject?ddc="+test.ddc), mocking.Header(nil), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []int64{}
+		for _, h := range hits {
+			got = append(got, h.Person.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("getSubject?ddc=%s: want %v, got %v", test.ddc, test.want, got)
+		}
+	}
+
+	status, _, _, _ = getSubject(mocking.URL(testMux, "GET", "http://test.com/api/subject?ddc=history"), mocking.Header(nil), nil)
+	if status != http.StatusBadRequest {
+		t.Errorf("getSubject with invalid number: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	for _, sp := range specialists {
+		deletePerson(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/person/%d", sp.ID)), mocking.Header(nil), nil)
+	}
+}
+
+func TestLocations(t *testing.T) {
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Kari Nordmann", Dept: 4, Role: "bibliotekar", Phone: "41 23 45 67",
+			Location: &location{Branch: " Grünerløkka ", Building: "Hovedbygget", Floor: "2", Room: "214"}},
+	)
+	if err != nil {
+		t.Fatalf("createPerson should succeed, got error: %v", err)
+	}
+	if p.Location.Branch != "Grünerløkka" {
+		t.Errorf("location should be trimmed, got %+v", p.Location)
+	}
+
+	// Updating without Location keeps it.
+	_, _, p, err = updatePerson(
+		mocking.URL(testMux, "PUT", fmt.Sprintf("http://test.com/api/person/%d", p.ID)),
+		mocking.Header(nil),
+		&person{Name: "Kari Nordmann", Dept: 4, Role: "spesialbibliotekar", Phone: "41 23 45 67"},
+	)
+	if err != nil {
+		t.Fatalf("updatePerson should succeed, got error: %v", err)
+	}
+	if p.Location.Room != "214" {
+		t.Errorf("location should be kept when missing from update, got %+v", p.Location)
+	}
+
+	_, _, persons, err := getAllPersons(mocking.URL(testMux, "GET", "http://test.com/api/person?branch=grünerløkka&floor=2"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 1 || persons[0].ID != p.ID {
+		t.Errorf("getAllPersons by location: want person %d, got %v", p.ID, persons)
+	}
+
+	_, _, persons, err = getAllPersons(mocking.URL(testMux, "GET", "http://test.com/api/person?branch=grünerløkka&floor=3"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(persons) != 0 {
+		t.Errorf("getAllPersons by other floor: want none, got %v", persons)
+	}
+
+	reindex()
+	_, _, res, err := searchPersons(mocking.URL(testMux, "GET", "http://test.com/api/search?q=kari&building=hovedbygget"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 1 || res.Hits[0] != int(p.ID) {
+		t.Errorf("searching by location: want person %d, got %v", p.ID, res.Hits)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d/vcard", p.ID)).String(), nil)
+	vcardHandler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/vcard; charset=utf-8" {
+		t.Fatalf("vcardHandler: want vCard, got %d %v", w.Code, w.Header())
+	}
+	for _, want := range []string{
+		"N:Nordmann;Kari;;;\r\n",
+		"TITLE:spesialbibliotekar\r\n",
+		"TEL;TYPE=WORK,CELL,PREF:41 23 45 67\r\n",
+		"ADR;TYPE=WORK:;2. etasje\\, rom 214;Hovedbygget;Grünerløkka;;;\r\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("vCard should contain %q, got %s", want, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "http://test.com/api/export/persons.csv", nil)
+	exportPersons(w, r)
+	if !strings.Contains(w.Body.String(), "Grünerløkka,Hovedbygget,2,214") {
+		t.Errorf("export should contain location, got %s", w.Body.String())
+	}
+
+	deletePerson(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), nil)
+}
+
+func TestAbsences(t *testing.T) {
+	now := time.Now()
+	day := func(offset int) string {
+		return now.AddDate(0, 0, offset).Format(dateLayout)
+	}
+
+	tests := []struct {
+		a      *absence
+		status int
+	}{
+		{&absence{Person: 9, Kind: "sabbatical", Start: day(0)}, http.StatusBadRequest},
+		{&absence{Person: 9, Kind: AbsenceVacation, Start: "1. juli"}, http.StatusBadRequest},
+		{&absence{Person: 9, Kind: AbsenceVacation, Start: day(2), End: day(1)}, http.StatusBadRequest},
+		{&absence{Person: 9, Kind: AbsenceVacation, Start: day(0), Substitute: 9}, http.StatusBadRequest},
+		{&absence{Person: 9, Kind: AbsenceVacation, Start: day(0), Substitute: 123456}, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		status, _, _, _ := createAbsence(mocking.URL(testMux, "POST", "http://test.com/api/absence"), mocking.Header(nil), test.a)
+		if status != test.status {
+			t.Errorf("createAbsence %+v: want %v, got %v", test.a, test.status, status)
+		}
+	}
+
+	_, _, current, err := createAbsence(
+		mocking.URL(testMux, "POST", "http://test.com/api/absence"),
+		mocking.Header(nil),
+		&absence{Person: 9, Kind: AbsenceVacation, Start: day(-1), End: day(1), Substitute: 8},
+	)
+	if err != nil {
+		t.Fatalf("createAbsence should succeed, got error: %v", err)
+	}
+	_, _, future, err := createAbsence(
+		mocking.URL(testMux, "POST", "http://test.com/api/absence"),
+		mocking.Header(nil),
+		&absence{Person: 9, Kind: AbsenceCourse, Start: day(10)},
+	)
+	if err != nil {
+		t.Fatalf("createAbsence should succeed, got error: %v", err)
+	}
+
+	_, _, p, err := getPerson(mocking.URL(testMux, "GET", "http://test.com/api/person/9"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Absence == nil || p.Absence.ID != current.ID {
+		t.Errorf("person should have current absence %d, got %+v", current.ID, p.Absence)
+	}
+
+	_, _, as, err := getAbsences(mocking.URL(testMux, "GET", "http://test.com/api/absence?person=9"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 2 || as[0].ID != current.ID || as[1].End != future.Start {
+		t.Errorf("getAbsences: want current and future absence, got %+v", as)
+	}
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://test.com/api/absences.ics?dept=2", nil)
+	absencesICS(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Fatalf("absencesICS: want calendar, got %d %v", w.Code, w.Header())
+	}
+	for _, want := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		fmt.Sprintf("UID:absence-%d@folk\r\n", current.ID),
+		"DTEND;VALUE=DATE:" + now.AddDate(0, 0, 2).Format("20060102") + "\r\n",
+		"SUMMARY:Mr. C: ferie\r\n",
+		"DESCRIPTION:Stedfortreder: Mr. B\r\n",
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("calendar should contain %q, got %s", want, w.Body.String())
+		}
+	}
+
+	for _, a := range []*absence{current, future} {
+		status, _, _, _ := deleteAbsence(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/absence/%d", a.ID)), mocking.Header(nil), nil)
+		if status != http.StatusNoContent {
+			t.Errorf("deleteAbsence: want %v, got %v", http.StatusNoContent, status)
+		}
+	}
+}
+
+func TestEmployment(t *testing.T) {
+	now := time.Now()
+	day := func(offset int) string {
+		return now.AddDate(0, 0, offset).Format(dateLayout)
+	}
+
+	status, _, _, _ := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Mr. Backwards", Dept: 4, Employment: &employment{Start: day(1), End: day(-1)}},
+	)
+	if status != http.StatusBadRequest {
+		t.Errorf("createPerson with reversed employment: want %v, got %v", http.StatusBadRequest, status)
+	}
+
+	var ids []int64
+	for _, p := range []*person{
+		{Name: "Vikar Ferdig", Dept: 6, Employment: &employment{Start: day(-100), End: day(-40)}},
+		{Name: "Vikar Snart", Dept: 6, Employment: &employment{Start: day(7)}},
+		{Name: "Vikar Nå", Dept: 6, Employment: &employment{Start: day(-7), End: day(7)}},
+	} {
+		_, _, p, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), p)
+		if err != nil {
+			t.Fatalf("createPerson should succeed, got error: %v", err)
+		}
+		ids = append(ids, p.ID)
+	}
+	departed, future, current := ids[0], ids[1], ids[2]
+
+	listed := func(url string) map[int64]bool {
+		_, _, persons, err := getAllPersons(mocking.URL(testMux, "GET", url), mocking.Header(nil), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := make(map[int64]bool)
+		for _, p := range persons {
+			res[p.ID] = true
+		}
+		return res
+	}
+	if got := listed("http://test.com/api/person"); got[departed] || got[future] || !got[current] {
+		t.Errorf("getAllPersons should only list employed persons, got %v", got)
+	}
+	if got := listed("http://test.com/api/person?inactive=true"); !got[departed] || !got[future] || !got[current] {
+		t.Errorf("getAllPersons?inactive=true should list everyone, got %v", got)
+	}
+
+	reindex()
+	_, _, res, err := searchPersons(mocking.URL(testMux, "GET", "http://test.com/api/search?q=vikar"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Count != 1 || res.Hits[0] != int(current) {
+		t.Errorf("searching should only find employed persons, want %d, got %v", current, res.Hits)
+	}
+
+	_, _, report, err := purgePersons(mocking.URL(testMux, "POST", "http://test.com/api/persons/purge?days=30"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun || len(report.Departed) != 1 || report.Departed[0].ID != departed || len(report.Removed) != 0 {
+		t.Errorf("purge dry run: got %+v", report)
+	}
+
+	_, _, report, err = purgePersons(mocking.URL(testMux, "POST", "http://test.com/api/persons/purge?days=30&dryrun=false"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0] != departed {
+		t.Errorf("purge: want %d removed, got %+v", departed, report)
+	}
+	status, _, _, _ = getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", departed)), mocking.Header(nil), nil)
+	if status != http.StatusNotFound {
+		t.Errorf("purged person: want %v, got %v", http.StatusNotFound, status)
+	}
+
+	for _, id := range []int64{future, current} {
+		deletePerson(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/person/%d", id)), mocking.Header(nil), nil)
+	}
+}
+
+func TestFeeds(t *testing.T) {
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{Name: "Ny & Nyttig", Dept: 5, Role: "bibliotekar"},
+	)
+	if err != nil {
+		t.Fatalf("createPerson should succeed, got error: %v", err)
+	}
+	if p.Created.IsZero() {
+		t.Errorf("created person should have Created set")
+	}
+
+	feed := func(handler http.HandlerFunc, url string) string {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", url, nil)
+		handler(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/atom+xml; charset=utf-8" {
+			t.Fatalf("%s: want Atom feed, got %d %v", url, w.Code, w.Header())
+		}
+		return w.Body.String()
+	}
+
+	body := feed(newPersonsFeed, "http://test.com/feeds/new.atom")
+	entry := fmt.Sprintf("<entry><id>urn:folk:person:%d</id><title>Ny &amp; Nyttig</title>", p.ID)
+	if !strings.Contains(body, `<feed xmlns="http://www.w3.org/2005/Atom">`) || !strings.Contains(body, entry) {
+		t.Errorf("new.atom should have the new person, got %s", body)
+	}
+	if strings.Index(body, entry) > strings.Index(body, "<entry>") {
+		t.Errorf("new.atom should have the newest person first, got %s", body)
+	}
+	if !strings.Contains(body, "<summary>bibliotekar, subA2</summary>") {
+		t.Errorf("entry should have role and department, got %s", body)
+	}
+
+	if body := feed(updatedPersonsFeed, "http://test.com/feeds/updated.atom?dept=2"); !strings.Contains(body, entry) {
+		t.Errorf("updated.atom?dept=2 should have the person, got %s", body)
+	}
+	if body := feed(updatedPersonsFeed, "http://test.com/feeds/updated.atom?dept=1"); strings.Contains(body, entry) {
+		t.Errorf("updated.atom?dept=1 should not have the person, got %s", body)
+	}
+	if body := feed(updatedPersonsFeed, "http://test.com/feeds/updated.atom"); !strings.Contains(body, "<id>http://test.com/feeds/updated.atom</id>") {
+		t.Errorf("feed ID should not have the query of earlier requests, got %s", body)
+	}
+
+	deletePerson(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), nil)
+}
+
+func TestWebhooks(t *testing.T) {
+	type received struct {
+		event, signature string
+		body             []byte
+	}
+	got := make(chan received, 10)
+	fail := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		got <- received{r.Header.Get("X-Folk-Event"), r.Header.Get("X-Folk-Signature"), body}
+	}))
+	defer receiver.Close()
+
+	tests := []struct {
+		w      *webhook
+		status int
+	}{
+		{&webhook{URL: "ftp://example.com"}, http.StatusBadRequest},
+		{&webhook{URL: "/relative"}, http.StatusBadRequest},
+		{&webhook{URL: receiver.URL, Events: []string{"person.renamed"}}, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		status, _, _, _ := createWebhook(mocking.URL(testMux, "POST", "http://test.com/api/webhook"), mocking.Header(nil), test.w)
+		if status != test.status {
+			t.Errorf("createWebhook %+v: want %v, got %v", test.w, test.status, status)
+		}
+	}
+
+	_, _, w, err := createWebhook(
+		mocking.URL(testMux, "POST", "http://test.com/api/webhook"),
+		mocking.Header(nil),
+		&webhook{URL: receiver.URL, Events: []string{"person.*"}},
+	)
+	if err != nil {
+		t.Fatalf("createWebhook should succeed, got error: %v", err)
+	}
+	if w.Secret == "" {
+		t.Errorf("webhook should be given a secret")
+	}
+
+	_, _, d, err := testWebhook(mocking.URL(testMux, "POST", fmt.Sprintf("http://test.com/api/webhook/%d/test", w.ID)), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Status != DeliveryDelivered || d.LastStatus != http.StatusOK {
+		t.Errorf("test delivery: got %+v", d)
+	}
+	if r := <-got; r.event != "ping" || r.signature != sign(w.Secret, r.body) {
+		t.Errorf("test delivery should be a signed ping, got %q %q", r.event, r.signature)
+	}
+
+	// Only subscribed events are queued.
+	createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Hooked"})
+	_, _, p, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: "Mr. Hook", Dept: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deliverPending(); err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	if r.event != "person.created" || r.signature != sign(w.Secret, r.body) {
+		t.Errorf("want signed person.created, got %q %q", r.event, r.signature)
+	}
+	var ev struct {
+		Type string
+		Data person
+	}
+	if err := json.Unmarshal(r.body, &ev); err != nil || ev.Type != "person.created" || ev.Data.ID != p.ID {
+		t.Errorf("payload should be the created person, got %s (%v)", r.body, err)
+	}
+	select {
+	case r := <-got:
+		t.Errorf("unsubscribed events should not be delivered, got %q", r.event)
+	default:
+	}
+
+	// Failed deliveries are retried later.
+	fail = true
+	deletePerson(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), nil)
+	if err := deliverPending(); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-got; r.event != "person.deleted" {
+		t.Errorf("want person.deleted, got %q", r.event)
+	}
+	_, _, ds, err := getDeliveries(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/webhook/%d/deliveries", w.ID)), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds) != 3 {
+		t.Fatalf("delivery log: want 3 deliveries, got %d", len(ds))
+	}
+	if ds[0].Event != "person.deleted" || ds[0].Status != DeliveryPending || ds[0].Attempts != 1 ||
+		ds[0].LastStatus != http.StatusServiceUnavailable || !ds[0].NextAttempt.After(time.Now()) {
+		t.Errorf("failed delivery should be retried later, got %+v", ds[0])
+	}
+	if ds[1].Event != "person.created" || ds[1].Status != DeliveryDelivered {
+		t.Errorf("delivered event: got %+v", ds[1])
+	}
+
+	status, _, _, _ := deleteWebhook(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/webhook/%d", w.ID)), mocking.Header(nil), nil)
+	if status != http.StatusNoContent {
+		t.Errorf("deleteWebhook: want %v, got %v", http.StatusNoContent, status)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer srv.Close()
+
+	type streamed struct {
+		id, event, data string
+	}
+	connect := func(query, lastID string) (*http.Response, *bufio.Reader) {
+		req, _ := http.NewRequest("GET", srv.URL+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+			t.Fatalf("Content-Type: want text/event-stream, got %q", ct)
+		}
+		return resp, bufio.NewReader(resp.Body)
+	}
+	// next returns the next event in the stream, skipping comments and the
+	// retry interval.
+	next := func(r *bufio.Reader) streamed {
+		var ev streamed
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("reading event stream: %v", err)
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "":
+				if ev.event != "" {
+					return ev
+				}
+			case strings.HasPrefix(line, "id: "):
+				ev.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				ev.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				ev.data = line[6:]
+			}
+		}
+	}
+
+	public, publicStream := connect("", "")
+	defer public.Body.Close()
+	internal, internalStream := connect("?internal=true", "")
+	defer internal.Body.Close()
+
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{
+			Name:   "Ms. Live",
+			Dept:   4,
+			Phones: []*contact{{Kind: ContactMobile, Value: "99887766"}},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		r      *bufio.Reader
+		phones int
+	}{
+		{publicStream, 0},
+		{internalStream, 1},
+	} {
+		ev := next(test.r)
+		if ev.event != "person.created" {
+			t.Fatalf("want person.created, got %+v", ev)
+		}
+		var msg struct {
+			Type string
+			Data person
+		}
+		if err := json.Unmarshal([]byte(ev.data), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Data.ID != p.ID || len(msg.Data.Phones) != test.phones {
+			t.Errorf("person.created: want person %d with %d phones, got %+v", p.ID, test.phones, msg.Data)
+		}
+	}
+
+	_, _, _, err = deletePerson(mocking.URL(testMux, "DELETE", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(publicStream); ev.event != "person.deleted" || !strings.Contains(ev.data, fmt.Sprintf(`"ID":%d`, p.ID)) {
+		t.Errorf("want person.deleted, got %+v", ev)
+	}
+
+	// A client reconnecting is sent the events it missed.
+	lastID, _ := strconv.ParseInt(next(internalStream).id, 10, 64)
+	resumed, resumedStream := connect("", strconv.FormatInt(lastID-2, 10))
+	if ev := next(resumedStream); ev.event != "person.created" || ev.id != strconv.FormatInt(lastID-1, 10) {
+		t.Errorf("resumed stream: want person.created with ID %d, got %+v", lastID-1, ev)
+	}
+	if ev := next(resumedStream); ev.event != "person.deleted" {
+		t.Errorf("resumed stream: want person.deleted, got %+v", ev)
+	}
+	resumed.Body.Close()
+
+	// Or told to reload, if the events are no longer known.
+	reset, resetStream := connect("", "1")
+	if ev := next(resetStream); ev.event != "reset" {
+		t.Errorf("want reset, got %+v", ev)
+	}
+	reset.Body.Close()
+}
+
+func TestETags(t *testing.T) {
+	_, h, p, err := getPerson(mocking.URL(testMux, "GET", "http://test.com/api/person/8"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := h.Get("ETag")
+	if tag == "" || h.Get("Last-Modified") == "" {
+		t.Fatalf("getPerson should return ETag and Last-Modified, got %v", h)
+	}
+
+	header := func(tag string) http.Header {
+		return mocking.Header(http.Header{"If-Match": {tag}})
+	}
+	status, _, _, _ := updatePerson(mocking.URL(testMux, "PUT", "http://test.com/api/person/8"), header(`"stale"`), p)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("updatePerson with stale If-Match: want %v, got %v", http.StatusPreconditionFailed, status)
+	}
+
+	p.Info = "first"
+	_, h2, _, err := updatePerson(mocking.URL(testMux, "PUT", "http://test.com/api/person/8"), header(tag), p)
+	if err != nil {
+		t.Fatalf("updatePerson with current If-Match should succeed, got error: %v", err)
+	}
+	if h2.Get("ETag") == tag {
+		t.Errorf("ETag should change on update")
+	}
+	_, h3, _, _ := getPerson(mocking.URL(testMux, "GET", "http://test.com/api/person/8"), mocking.Header(nil), nil)
+	if h3.Get("ETag") != h2.Get("ETag") {
+		t.Errorf("updatePerson and getPerson should agree on ETag: %q != %q", h2.Get("ETag"), h3.Get("ETag"))
+	}
+
+	// A concurrent edit based on the first version is rejected.
+	p.Info = "second"
+	status, _, _, _ = updatePerson(mocking.URL(testMux, "PUT", "http://test.com/api/person/8"), header(tag), p)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("updatePerson with old ETag: want %v, got %v", http.StatusPreconditionFailed, status)
+	}
+
+	_, h, d, err := getDepartment(mocking.URL(testMux, "GET", "http://test.com/api/department/6"), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag = h.Get("ETag")
+	_, h2, _, err = updateDepartment(mocking.URL(testMux, "PUT", "http://test.com/api/department/6"), header(tag), d)
+	if err != nil {
+		t.Fatalf("updateDepartment with current If-Match should succeed, got error: %v", err)
+	}
+	if h2.Get("Last-Modified") == "" || h2.Get("ETag") == tag {
+		t.Errorf("updateDepartment should return a new ETag and Last-Modified, got %v", h2)
+	}
+	status, _, _, _ = updateDepartment(mocking.URL(testMux, "PUT", "http://test.com/api/department/6"), header(tag), d)
+	if status != http.StatusPreconditionFailed {
+		t.Errorf("updateDepartment with old ETag: want %v, got %v", http.StatusPreconditionFailed, status)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	for _, name := range []string{"darning", "knitting", "weaving"} {
+		createTag(mocking.URL(testMux, "POST", "http://test.com/api/tags"), mocking.Header(nil), &tag{Name: name, Kind: TagSkill})
+	}
+	_, _, p, err := createPerson(
+		mocking.URL(testMux, "POST", "http://test.com/api/person"),
+		mocking.Header(nil),
+		&person{
+			Name:   "Ms. Patch",
+			Dept:   4,
+			Info:   "keep me",
+			Img:    "patch.png",
+			Phones: []*contact{{Kind: ContactDesk, Value: "11111111", Public: true}},
+			Tags:   []string{"darning"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("http://test.com/api/person/%d", p.ID)
+
+	patch := func(handler http.HandlerFunc, path, contentType, ifMatch, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PATCH", mocking.URL(testMux, "PATCH", path).String(), strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		if ifMatch != "" {
+			r.Header.Set("If-Match", ifMatch)
+		}
+		handler(w, r)
+		return w
+	}
+	get := func() *person {
+		_, _, p, err := getPerson(mocking.URL(testMux, "GET", path+"?internal=true"), mocking.Header(nil), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// Changing only Phone changes the preferred phone number, keeping the rest.
+	w := patch(patchPerson, path, "application/merge-patch+json", "", `{"Phone": "22222222"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("merge patch: want 200, got %d %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("ETag") == "" {
+		t.Errorf("merge patch should return an ETag")
+	}
+	got := get()
+	if got.Phone != "22222222" || len(got.Phones) != 1 || got.Info != "keep me" || got.Img != "patch.png" || !reflect.DeepEqual(got.Tags, []string{"darning"}) {
+		t.Errorf("merge patch of Phone: got %+v", got)
+	}
+
+	w = patch(patchPerson, path, "application/merge-patch+json", "", `{"Info": null, "Tags": ["darning", "knitting"]}`)
+	if got = get(); w.Code != http.StatusOK || got.Info != "" || !reflect.DeepEqual(got.Tags, []string{"darning", "knitting"}) {
+		t.Errorf("merge patch removing Info and setting Tags: got %d %+v", w.Code, got)
+	}
+
+	w = patch(patchPerson, path, "application/json-patch+json", "", `[
+		{"op": "test", "path": "/Name", "value": "Ms. Patch"},
+		{"op": "add", "path": "/Tags/-", "value": "weaving"},
+		{"op": "remove", "path": "/Tags/0"},
+		{"op": "replace", "path": "/Role", "value": "sjef"},
+		{"op": "copy", "from": "/Name", "path": "/Info"}
+	]`)
+	if got = get(); w.Code != http.StatusOK || got.Role != "sjef" || got.Info != "Ms. Patch" || !reflect.DeepEqual(got.Tags, []string{"knitting", "weaving"}) {
+		t.Errorf("JSON patch: got %d %s %+v", w.Code, w.Body.String(), got)
+	}
+
+	tests := []struct {
+		contentType, ifMatch, body string
+		status                     int
+	}{
+		{"text/plain", "", `{"Info": "x"}`, http.StatusUnsupportedMediaType},
+		{"application/merge-patch+json", "", `{"Name": ""}`, http.StatusBadRequest},
+		{"application/merge-patch+json", "", `{"Nickname": "x"}`, http.StatusBadRequest},
+		{"application/merge-patch+json", "", `{"Dept": 999999}`, http.StatusNotFound},
+		{"application/merge-patch+json", `"stale"`, `{"Info": "x"}`, http.StatusPreconditionFailed},
+		{"application/json-patch+json", "", `{"op": "add"}`, http.StatusBadRequest},
+		{"application/json-patch+json", "", `[{"op": "frobnicate", "path": "/Info"}]`, http.StatusBadRequest},
+		{"application/json-patch+json", "", `[{"op": "test", "path": "/Name", "value": "Mr. Patch"}]`, http.StatusConflict},
+		{"application/json-patch+json", "", `[{"op": "remove", "path": "/Tags/5"}]`, http.StatusConflict},
+	}
+	for _, test := range tests {
+		if w := patch(patchPerson, path, test.contentType, test.ifMatch, test.body); w.Code != test.status {
+			t.Errorf("patch %s %s: want %d, got %d %s", test.contentType, test.body, test.status, w.Code, w.Body.String())
+		}
+	}
+	if got = get(); got.Name != "Ms. Patch" || got.Role != "sjef" {
+		t.Errorf("failed patches should not change the person, got %+v", got)
+	}
+
+	w = patch(patchDepartment, "http://test.com/api/department/6", "application/merge-patch+json", "", `{"Name": "subB1 patched"}`)
+	_, _, d, _ := getDepartment(mocking.URL(testMux, "GET", "http://test.com/api/department/6"), mocking.Header(nil), nil)
+	if w.Code != http.StatusOK || d.Name != "subB1 patched" || d.Parent != 1 {
+		t.Errorf("department merge patch: got %d %+v", w.Code, d)
+	}
+	w = patch(patchDepartment, "http://test.com/api/department/6", "application/json-patch+json", "", `[{"op": "replace", "path": "/Name", "value": "subB1"}]`)
+	if w.Code != http.StatusOK {
+		t.Errorf("department JSON patch: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatch(t *testing.T) {
+	get := func(id int64) *person {
+		_, _, p, err := getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d?internal=true", id)), mocking.Header(nil), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	batch := func(ops ...*batchOp) (int, *batchResponse) {
+		status, _, res, _ := runBatch(mocking.URL(testMux, "POST", "http://test.com/api/batch"), mocking.Header(nil), &batchRequest{Operations: ops})
+		return status, res
+	}
+
+	// Moving Mr. A fails along with the last operation.
+	a := get(7)
+	moved := *a
+	moved.Dept, moved.Memberships = 5, nil
+	status, res := batch(
+		&batchOp{Op: "update", Type: "person", ID: 7, Person: &moved},
+		&batchOp{Op: "create", Type: "person", Person: &person{Name: "Ms. Rollback", Dept: 4}},
+		&batchOp{Op: "update", Type: "department", ID: 999999, Department: &department{Name: "nowhere"}},
+	)
+	if status != http.StatusNotFound || res.Committed || len(res.Results) != 3 ||
+		res.Results[0].Status != http.StatusOK || res.Results[2].Error == "" {
+		t.Fatalf("failing batch: got %d %+v", status, res)
+	}
+	if got := get(7); got.Dept != 4 || !got.Updated.Equal(a.Updated) {
+		t.Errorf("failing batch should not move Mr. A, got %+v", got)
+	}
+	created := res.Results[1].Person.ID
+	if status, _, _, _ := getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", created)), mocking.Header(nil), nil); status != http.StatusNotFound {
+		t.Errorf("failing batch should not create person, got %d", status)
+	}
+	_, _, sr, _ := searchPersons(mocking.URL(testMux, "GET", "http://test.com/api/search?q=rollback"), mocking.Header(nil), nil)
+	if sr.Count != 0 {
+		t.Errorf("failing batch should not index person, got %v", sr.Hits)
+	}
+
+	status, res = batch(
+		&batchOp{Op: "update", Type: "person", ID: 7, IfMatch: `"stale"`, Person: &moved},
+	)
+	if status != http.StatusPreconditionFailed || res.Committed {
+		t.Errorf("batch with stale If-Match: got %d %+v", status, res)
+	}
+
+	status, res = batch(
+		&batchOp{Op: "create", Type: "department", Department: &department{Name: "Batched", Parent: 1}},
+		&batchOp{Op: "update", Type: "person", ID: 7, IfMatch: etag(a.Updated), Person: &moved},
+		&batchOp{Op: "create", Type: "person", Person: &person{Name: "Ms. Batched", Dept: 5}},
+	)
+	if status != http.StatusOK || !res.Committed || len(res.Results) != 3 {
+		t.Fatalf("batch: got %d %+v", status, res)
+	}
+	if got := get(7); got.Dept != 5 || res.Results[1].ETag != etag(got.Updated) {
+		t.Errorf("batch should move Mr. A, got %+v", got)
+	}
+	newPerson, newDept := res.Results[2].Person.ID, res.Results[0].Department.ID
+	if got := get(newPerson); got.Name != "Ms. Batched" {
+		t.Errorf("batch should create person, got %+v", got)
+	}
+
+	// Undo, deleting what was created.
+	a.Memberships = nil
+	status, res = batch(
+		&batchOp{Op: "update", Type: "person", ID: 7, Person: a},
+		&batchOp{Op: "delete", Type: "person", ID: newPerson},
+		&batchOp{Op: "delete", Type: "department", ID: newDept},
+	)
+	if status != http.StatusOK || !res.Committed {
+		t.Fatalf("batch: got %d %+v", status, res)
+	}
+	if got := get(7); got.Dept != 4 {
+		t.Errorf("batch should move Mr. A back, got %+v", got)
+	}
+
+	if status, _ := batch(&batchOp{Op: "rename", Type: "person", ID: 7}); status != http.StatusBadRequest {
+		t.Errorf("unknown operation: want %d, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestBatchWithReaders(t *testing.T) {
+	_, _, p, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: "Ms. Original", Dept: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("http://test.com/api/person/%d", p.ID)
+
+	// Reads while the batch is running wait for it, instead of failing.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if status, _, _, err := getPerson(mocking.URL(testMux, "GET", url), mocking.Header(nil), nil); status != http.StatusOK {
+					t.Errorf("getPerson during batch: want %d, got %d %v", http.StatusOK, status, err)
+					return
+				}
+				if status, _, _, err := getAllPersons(mocking.URL(testMux, "GET", "http://test.com/api/person"), mocking.Header(nil), nil); status != http.StatusOK {
+					t.Errorf("getAllPersons during batch: want %d, got %d %v", http.StatusOK, status, err)
+					return
+				}
+			}
+		}()
+	}
+
+	// The person is renamed back and forth; the index must end up with the
+	// last name only.
+	var ops []*batchOp
+	for i := 0; i < 100; i++ {
+		q := *p
+		q.Memberships = nil
+		q.Name = "Ms. Interim"
+		if i%2 == 1 {
+			q.Name = "Ms. Final"
+		}
+		ops = append(ops, &batchOp{Op: "update", Type: "person", ID: p.ID, Person: &q})
+	}
+	status, _, res, err := runBatch(mocking.URL(testMux, "POST", "http://test.com/api/batch"), mocking.Header(nil), &batchRequest{Operations: ops})
+	close(done)
+	wg.Wait()
+	if status != http.StatusOK || !res.Committed {
+		t.Fatalf("batch: got %d %v", status, err)
+	}
+
+	for q, want := range map[string]int{"interim": 0, "original": 0, "final": 1} {
+		_, _, sr, _ := searchPersons(mocking.URL(testMux, "GET", "http://test.com/api/search?q="+q), mocking.Header(nil), nil)
+		if sr.Count != want {
+			t.Errorf("search for %q after batch: want %d hits, got %v", q, want, sr.Hits)
+		}
+	}
+
+	deletePerson(mocking.URL(testMux, "DELETE", url), mocking.Header(nil), nil)
+}
+
+func TestMergeAndSplitDepartments(t *testing.T) {
+	_, _, a, err := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Merged away"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, b, _ := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Merged into"})
+	_, _, sub, _ := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Sub", Parent: a.ID})
+
+	// Ms. Both is a member of both; Mr. Only only of the one merged away.
+	_, _, both, _ := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil),
+		&person{Name: "Ms. Both", Memberships: []*membership{{Dept: a.ID, Role: "leder", Primary: true}, {Dept: b.ID}}})
+	_, _, only, _ := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil),
+		&person{Name: "Mr. Only", Dept: a.ID, Role: "konsulent"})
+
+	merge := func(id, target int64) (int, *restructureReport) {
+		status, _, r, _ := mergeDepartment(mocking.URL(testMux, "POST", fmt.Sprintf("http://test.com/api/department/%d/merge-into/%d", id, target)), mocking.Header(nil), nil)
+		return status, r
+	}
+	if status, _ := merge(a.ID, a.ID); status != http.StatusBadRequest {
+		t.Errorf("merge into itself: want %d, got %d", http.StatusBadRequest, status)
+	}
+	if status, _ := merge(a.ID, sub.ID); status != http.StatusBadRequest {
+		t.Errorf("merge into subdepartment: want %d, got %d", http.StatusBadRequest, status)
+	}
+	if status, _ := merge(a.ID, 999999); status != http.StatusNotFound {
+		t.Errorf("merge into missing department: want %d, got %d", http.StatusNotFound, status)
+	}
+
+	status, r := merge(a.ID, b.ID)
+	if status != http.StatusOK || len(r.Persons) != 2 || !reflect.DeepEqual(r.Departments, []int64{sub.ID}) {
+		t.Fatalf("merge: got %d %+v", status, r)
+	}
+	if status, _, _, _ := getDepartment(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/department/%d", a.ID)), mocking.Header(nil), nil); status != http.StatusNotFound {
+		t.Errorf("merged department should be deleted, got %d", status)
+	}
+	_, _, d, _ := getDepartment(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/department/%d", sub.ID)), mocking.Header(nil), nil)
+	if d.Parent != b.ID {
+		t.Errorf("subdepartment should be moved, got parent %d", d.Parent)
+	}
+	_, _, p, _ := getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", both.ID)), mocking.Header(nil), nil)
+	if p.Dept != b.ID || len(p.Memberships) != 1 || !p.Memberships[0].Primary {
+		t.Errorf("Ms. Both should have one primary membership in %d, got %d %+v", b.ID, p.Dept, p.Memberships[0])
+	}
+	_, _, p, _ = getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", only.ID)), mocking.Header(nil), nil)
+	if p.Dept != b.ID || p.Role != "konsulent" {
+		t.Errorf("Mr. Only should be moved keeping his role, got %+v", p)
+	}
+
+	split := func(id int64, req *splitRequest) (int, *restructureReport) {
+		status, _, r, _ := splitDepartment(mocking.URL(testMux, "POST", fmt.Sprintf("http://test.com/api/department/%d/split", id)), mocking.Header(nil), req)
+		return status, r
+	}
+	if status, _ := split(b.ID, &splitRequest{Name: "Split off", Persons: []int64{7}}); status != http.StatusBadRequest {
+		t.Errorf("split with non-member: want %d, got %d", http.StatusBadRequest, status)
+	}
+	if status, _ := split(b.ID, &splitRequest{Name: " ", Persons: []int64{only.ID}}); status != http.StatusBadRequest {
+		t.Errorf("split without name: want %d, got %d", http.StatusBadRequest, status)
+	}
+	status, r = split(b.ID, &splitRequest{Name: "Split off", Persons: []int64{only.ID}})
+	if status != http.StatusCreated || r.Department.ID == 0 || r.Department.Parent != b.Parent {
+		t.Fatalf("split: got %d %+v", status, r)
+	}
+	_, _, p, _ = getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", only.ID)), mocking.Header(nil), nil)
+	if p.Dept != r.Department.ID {
+		t.Errorf("Mr. Only should be moved to the new department, got %d", p.Dept)
+	}
+	_, _, p, _ = getPerson(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person/%d", both.ID)), mocking.Header(nil), nil)
+	if p.Dept != b.ID {
+		t.Errorf("Ms. Both should stay, got %d", p.Dept)
+	}
+}
+
+func TestGetDepartmentPersons(t *testing.T) {
+	_, _, top, err := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Branch"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, sub, _ := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Branch office", Parent: top.ID})
+	for _, p := range []*person{{Name: "Ms. Top", Dept: top.ID}, {Name: "Mr. Sub", Dept: sub.ID}, {Name: "Ms. Also sub", Dept: sub.ID}} {
+		if _, _, _, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(query string) (int, []string) {
+		status, _, ps, _ := getDepartmentPersons(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/department/%d/persons%s", top.ID, query)), mocking.Header(nil), nil)
+		var res []string
+		for _, p := range ps {
+			res = append(res, p.Name)
+		}
+		return status, res
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"Ms. Top"}},
+		{"?recursive=true", []string{"Mr. Sub", "Ms. Also sub", "Ms. Top"}},
+		{"?recursive=true&sort=-name", []string{"Ms. Top", "Ms. Also sub", "Mr. Sub"}},
+		{"?recursive=true&offset=1&limit=1", []string{"Ms. Also sub"}},
+	}
+	for _, tt := range tests {
+		status, got := names(tt.query)
+		if status != http.StatusOK || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: want %v, got %d %v", tt.query, tt.want, status, got)
+		}
+	}
+
+	if status, _ := names("?sort=age"); status != http.StatusBadRequest {
+		t.Errorf("unknown sort order: want %d, got %d", http.StatusBadRequest, status)
+	}
+	if status, _, _, _ := getDepartmentPersons(mocking.URL(testMux, "GET", "http://test.com/api/department/999999/persons"), mocking.Header(nil), nil); status != http.StatusNotFound {
+		t.Errorf("missing department: want %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestGetAllPersonsFilteredAndSorted(t *testing.T) {
+	_, _, dept, err := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Signage"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*person{{Name: "Ms. Sign", Dept: dept.ID, Role: "skiltmaker"}, {Name: "Mr. Post", Dept: dept.ID, Role: "bud"}, {Name: "Mr. Age", Dept: dept.ID, Role: "Skiltmaker"}} {
+		if _, _, _, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	names := func(query string) (int, []string) {
+		status, _, ps, _ := getAllPersons(mocking.URL(testMux, "GET", "http://test.com/api/person?"+query), mocking.Header(nil), nil)
+		var res []string
+		for _, p := range ps {
+			res = append(res, p.Name)
+		}
+		return status, res
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{fmt.Sprintf("dept=%d&sort=name", dept.ID), []string{"Mr. Age", "Mr. Post", "Ms. Sign"}},
+		{fmt.Sprintf("dept=%d&sort=-name", dept.ID), []string{"Ms. Sign", "Mr. Post", "Mr. Age"}},
+		{fmt.Sprintf("dept=%d&sort=dept", dept.ID), []string{"Mr. Age", "Mr. Post", "Ms. Sign"}},
+		{fmt.Sprintf("dept=%d&role=skiltmaker&sort=name", dept.ID), []string{"Mr. Age", "Ms. Sign"}},
+		{fmt.Sprintf("dept=%d&hasImage=false&sort=name&limit=1&offset=1", dept.ID), []string{"Mr. Post"}},
+		{fmt.Sprintf("dept=%d&updatedSince=2999-01-01", dept.ID), nil},
+	}
+	for _, tt := range tests {
+		status, got := names(tt.query)
+		if status != http.StatusOK || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: want %v, got %d %v", tt.query, tt.want, status, got)
+		}
+	}
+	for _, query := range []string{"sort=age", "hasImage=maybe", "updatedSince=yesterday", "dept=x"} {
+		if status, _ := names(query); status != http.StatusBadRequest {
+			t.Errorf("%q: want %d, got %d", query, http.StatusBadRequest, status)
+		}
+	}
+
+	_, _, res, err := getPersons(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person?dept=%d&sort=name&fields=name,email", dept.ID)), mocking.Header(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := res.([]map[string]json.RawMessage)
+	if len(ps) != 3 || len(ps[0]) != 3 || string(ps[0]["Name"]) != `"Mr. Age"` || ps[0]["ID"] == nil || ps[0]["Email"] == nil {
+		t.Errorf("fields=name,email: want ID, Name and Email, got %s", ps)
+	}
+	if status, _, _, _ := getPersons(mocking.URL(testMux, "GET", "http://test.com/api/person?fields=age"), mocking.Header(nil), nil); status != http.StatusBadRequest {
+		t.Errorf("unknown field: want %d, got %d", http.StatusBadRequest, status)
+	}
+}
+
+func TestCursorPagination(t *testing.T) {
+	_, _, dept, err := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Paged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"P1", "P2", "P3", "P4", "P5"} {
+		if _, _, _, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: name, Dept: dept.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// links returns the URLs of the Link header, by relation.
+	links := func(h http.Header) map[string]string {
+		res := make(map[string]string)
+		for _, l := range h["Link"] {
+			parts := strings.SplitN(l, ">; rel=", 2)
+			res[strings.Trim(parts[1], `"`)] = strings.TrimPrefix(parts[0], "<")
+		}
+		return res
+	}
+	get := func(rawurl string) (http.Header, []string) {
+		status, h, ps, err := getAllPersons(mocking.URL(testMux, "GET", rawurl), mocking.Header(nil), nil)
+		if status != http.StatusOK {
+			t.Fatalf("%s: got %d %v", rawurl, status, err)
+		}
+		var names []string
+		for _, p := range ps {
+			names = append(names, p.Name)
+		}
+		return h, names
+	}
+
+	h, names := get(fmt.Sprintf("http://test.com/api/person?dept=%d&limit=2", dept.ID))
+	if !reflect.DeepEqual(names, []string{"P5", "P4"}) || h.Get("X-Total-Count") != "5" {
+		t.Fatalf("first page: got %v of %s", names, h.Get("X-Total-Count"))
+	}
+	if _, ok := links(h)["prev"]; ok {
+		t.Errorf("first page should have no previous page")
+	}
+
+	// A person created while paging doesn't shift the pages.
+	createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: "P6", Dept: dept.ID})
+	h, names = get(links(h)["next"])
+	if !reflect.DeepEqual(names, []string{"P3", "P2"}) || h.Get("X-Total-Count") != "6" {
+		t.Errorf("second page: got %v of %s", names, h.Get("X-Total-Count"))
+	}
+	next, prev := links(h)["next"], links(h)["prev"]
+	if _, names = get(next); !reflect.DeepEqual(names, []string{"P1"}) {
+		t.Errorf("last page: got %v", names)
+	}
+	if _, names = get(prev); !reflect.DeepEqual(names, []string{"P5", "P4"}) {
+		t.Errorf("previous page: got %v", names)
+	}
+
+	if status, _, _, _ := getAllPersons(mocking.URL(testMux, "GET", "http://test.com/api/person?cursor=garbage"), mocking.Header(nil), nil); status != http.StatusBadRequest {
+		t.Errorf("invalid cursor: want %d, got %d", http.StatusBadRequest, status)
+	}
+	next = strings.Replace(next, "limit=2", "limit=2&sort=name", 1)
+	if status, _, _, _ := getAllPersons(mocking.URL(testMux, "GET", next), mocking.Header(nil), nil); status != http.StatusBadRequest {
+		t.Errorf("cursor of other order: want %d, got %d", http.StatusBadRequest, status)
+	}
+
+	_, h, depts, _ := getAllDepartments(mocking.URL(testMux, "GET", "http://test.com/api/department?limit=1"), mocking.Header(nil), nil)
+	total, _ := strconv.Atoi(h.Get("X-Total-Count"))
+	if len(depts) != 1 || total < 2 || links(h)["next"] == "" {
+		t.Errorf("departments: got %d of %d, links %v", len(depts), total, h["Link"])
+	}
+	_, _, all, _ := getAllDepartments(mocking.URL(testMux, "GET", "http://test.com/api/department"), mocking.Header(nil), nil)
+	_, _, depts, _ = getAllDepartments(mocking.URL(testMux, "GET", links(h)["next"]), mocking.Header(nil), nil)
+	if len(all) != total || len(depts) != 1 || depts[0].ID != all[1].ID {
+		t.Errorf("second department: want %+v, got %+v", all[1], depts)
+	}
+}
+
+func TestNorwegianCollation(t *testing.T) {
+	names := []string{"Zara", "åse", "Øystein", "Aasen", "Eva", "Æsa", "émile", "Anne"}
+	sort.Slice(names, func(i, j int) bool { return collationKey(names[i]) < collationKey(names[j]) })
+	want := []string{"Anne", "émile", "Eva", "Zara", "Æsa", "Øystein", "åse", "Aasen"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("Norwegian order: want %v, got %v", want, names)
+	}
+
+	_, _, dept, err := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Alfabetisk"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ps []*person
+	for _, name := range []string{"Åse Berg", "Anne Aas", "Per Zahl"} {
+		_, _, p, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: name, Dept: dept.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ps = append(ps, p)
+	}
+	if ps[0].SortName != "Berg, Åse" {
+		t.Errorf("sort name should default to family name first, got %q", ps[0].SortName)
+	}
+
+	sorted := func(by string) []string {
+		_, _, res, _ := getAllPersons(mocking.URL(testMux, "GET", fmt.Sprintf("http://test.com/api/person?dept=%d&sort=%s", dept.ID, by)), mocking.Header(nil), nil)
+		var got []string
+		for _, p := range res {
+			got = append(got, p.Name)
+		}
+		return got
+	}
+	if got, want := sorted("name"), []string{"Anne Aas", "Per Zahl", "Åse Berg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sort=name: want %v, got %v", want, got)
+	}
+	if got, want := sorted("sortName"), []string{"Åse Berg", "Per Zahl", "Anne Aas"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sort=sortName: want %v, got %v", want, got)
+	}
+
+	// A sort name given is kept, while a default one follows the name.
+	p := ps[2]
+	p.SortName = "Aaa, Per"
+	updatePerson(mocking.URL(testMux, "PUT", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), p)
+	p.Name, p.SortName = "Per Zahl-Olsen", ""
+	_, _, p, _ = updatePerson(mocking.URL(testMux, "PUT", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), p)
+	if p.SortName != "Aaa, Per" {
+		t.Errorf("sort name given should be kept, got %q", p.SortName)
+	}
+	p = ps[0]
+	p.Name = "Åse Berg Li"
+	_, _, p, _ = updatePerson(mocking.URL(testMux, "PUT", fmt.Sprintf("http://test.com/api/person/%d", p.ID)), mocking.Header(nil), p)
+	if p.SortName != "Li, Åse Berg" {
+		t.Errorf("default sort name should follow the name, got %q", p.SortName)
+	}
+}
+
+func TestDeptMembersWithCycle(t *testing.T) {
+	_, _, a, err := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Cycle A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, b, _ := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Cycle B", Parent: a.ID})
+	_, _, p, _ := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: "Mr. Round", Dept: b.ID})
+
+	// Made before cycles were rejected
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qUpdateDept, a.Name, b.ID, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Execute(ctx, qUpdateDept, a.Name, int64(0), a.ID)
+
+	members, err := deptMembers(ctx, a.ID)
+	if err != nil || len(members) != 1 || !members[p.ID] {
+		t.Errorf("deptMembers with a cycle: want %d, got %v %v", p.ID, members, err)
+	}
+
+	_, _, c, _ := createDepartment(mocking.URL(testMux, "POST", "http://test.com/api/department"), mocking.Header(nil), &department{Name: "Cycle C"})
+	status, _, _, err := mergeDepartment(mocking.URL(testMux, "POST", fmt.Sprintf("http://test.com/api/department/%d/merge-into/%d", c.ID, a.ID)), mocking.Header(nil), nil)
+	if status != http.StatusOK {
+		t.Errorf("merge into a department in a cycle: want %d, got %d %v", http.StatusOK, status, err)
+	}
+}
+
+func TestConcurrentUpdatesOfSameVersion(t *testing.T) {
+	_, _, p, err := createPerson(mocking.URL(testMux, "POST", "http://test.com/api/person"), mocking.Header(nil), &person{Name: "Ms. Contested", Dept: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("http://test.com/api/person/%d", p.ID)
+	status, h, _, err := getPerson(mocking.URL(testMux, "GET", url), mocking.Header(nil), nil)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("getPerson: want %d, got %d %v", http.StatusOK, status, err)
+	}
+	tag := h.Get("ETag")
+
+	const n = 5
+	statuses := make(chan int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			status, _, q, err := getPerson(mocking.URL(testMux, "GET", url), mocking.Header(nil), nil)
+			if err != nil || status != http.StatusOK {
+				t.Errorf("concurrent getPerson: want %d, got %d %v", http.StatusOK, status, err)
+				return
+			}
+			q.Role = fmt.Sprintf("role %d", i)
+			status, _, _, _ = updatePerson(mocking.URL(testMux, "PUT", url), http.Header{"If-Match": {tag}}, q)
+			statuses <- status
+		}(i)
+	}
+	wg.Wait()
+	close(statuses)
+
+	ok := 0
+	for status := range statuses {
+		switch status {
+		case http.StatusOK:
+			ok++
+		case http.StatusPreconditionFailed:
+		default:
+			t.Errorf("concurrent update: want %d or %d, got %d", http.StatusOK, http.StatusPreconditionFailed, status)
+		}
+	}
+	if ok != 1 {
+		t.Errorf("updates of the same version: want 1 to succeed, got %d", ok)
+	}
+}
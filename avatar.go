@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// avatarColors are the background colors of generated avatars. They are all
+// dark enough to give white text sufficient contrast (WCAG AA).
+var avatarColors = []string{
+	"#1f5f8b", "#2e7d32", "#6a1b9a", "#ad1457", "#c62828", "#00695c",
+	"#4e342e", "#37474f", "#283593", "#558b2f", "#8e24aa", "#bf360c",
+}
+
+// initials returns the uppercased first letters of the first and last
+// words in name.
+func initials(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-'
+	})
+	var res []rune
+	for i, w := range words {
+		if i != 0 && i != len(words)-1 {
+			continue
+		}
+		r, _ := utf8.DecodeRuneInString(w)
+		if unicode.IsLetter(r) {
+			res = append(res, unicode.ToUpper(r))
+		}
+	}
+	if len(res) == 0 {
+		return "?"
+	}
+	return string(res)
+}
+
+// avatarColor returns a background color derived from n.
+func avatarColor(n int64) string {
+	h := fnv.New32a()
+	h.Write([]byte(strconv.FormatInt(n, 10)))
+	return avatarColors[h.Sum32()%uint32(len(avatarColors))]
+}
+
+// avatarSVG returns a square SVG image with the initials of name in white on
+// the given background color.
+func avatarSVG(name, color string) []byte {
+	var label, text bytes.Buffer
+	xml.EscapeText(&label, []byte(name))
+	xml.EscapeText(&text, []byte(initials(name)))
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="200" height="200" viewBox="0 0 200 200" role="img" aria-label="%s">`, label.String())
+	fmt.Fprintf(&b, `<rect width="200" height="200" fill="%s"/>`, color)
+	fmt.Fprintf(&b, `<text x="100" y="100" dy=".35em" text-anchor="middle" font-family="sans-serif" font-size="80" fill="#ffffff">%s</text>`, text.String())
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+// GET /person/{id}/avatar
+//
+// avatarHandler redirects to the person's image, or serves a generated avatar
+// with the person's initials if the person has no image or the image file is
+// missing. The avatar color is derived from the person ID, or from the
+// department ID with the parameter color=dept.
+func avatarHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("id")
+	if idStr == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing ID parameter"))
+		return
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("person ID must be an integer"))
+		return
+	}
+
+	ctx := readCtx
+	p, err := fetchPerson(ctx, int64(id))
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "avatarHandler", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+
+	if p == nil {
+		writeError(w, http.StatusNotFound, errors.New("person not found"))
+		return
+	}
+
+	if p.Img != "" && imageFiles.get(p.Img) != nil {
+		http.Redirect(w, r, "/img/"+p.Img, http.StatusFound)
+		return
+	}
+
+	colorBy := p.ID
+	if r.URL.Query().Get("color") == "dept" {
+		colorBy = p.Dept
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(avatarSVG(p.Name, avatarColor(colorBy)))
+}
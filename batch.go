@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// MaxBatchOperations is the maximum number of operations in a batch.
+const MaxBatchOperations = 1000
+
+// afterCommit holds what to do once changes are committed, such as updating
+// the search index and emitting events.
+type afterCommit []func()
+
+// add adds f to be run after commit.
+func (a *afterCommit) add(f func()) {
+	*a = append(*a, f)
+}
+
+// run runs everything added, in order.
+func (a afterCommit) run() {
+	for _, f := range a {
+		f()
+	}
+}
+
+// batchOp is an operation of a batch.
+type batchOp struct {
+	Op         string      // "create", "update" or "delete"
+	Type       string      // "person" or "department"
+	ID         int64       // the person or department to update or delete
+	IfMatch    string      // if given, the ETag the person or department to update must have
+	Person     *person     // the person to create or update
+	Department *department // the department to create or update
+}
+
+// batchRequest is a list of operations to run all or none of.
+type batchRequest struct {
+	Operations []*batchOp
+}
+
+// batchResult is the result of an operation of a batch.
+type batchResult struct {
+	Status     int         // the HTTP status code the operation would have on its own
+	Error      string      `json:",omitempty"`
+	ETag       string      `json:",omitempty"` // of the person or department created or updated
+	Person     *person     `json:",omitempty"`
+	Department *department `json:",omitempty"`
+}
+
+// batchResponse is the result of a batch. If an operation fails, nothing is
+// committed, and the results end with that of the failed operation.
+type batchResponse struct {
+	Committed bool
+	Results   []*batchResult
+}
+
+// runBatchOp runs the operation in the transaction of ctx.
+func runBatchOp(ctx *ql.TCtx, after *afterCommit, op *batchOp) *batchResult {
+	h := http.Header{}
+	if op.IfMatch != "" {
+		h.Set("If-Match", op.IfMatch)
+	}
+
+	res := &batchResult{}
+	var err error
+	switch op.Type + "." + op.Op {
+	case "person.create", "person.update":
+		if op.Person == nil {
+			res.Status, err = http.StatusBadRequest, errors.New("missing person")
+			break
+		}
+		if op.Op == "create" {
+			res.Status, err = addPerson(ctx, after, op.Person)
+		} else {
+			res.Status, err = changePerson(ctx, after, int(op.ID), h, op.Person)
+		}
+		if err == nil {
+			res.Person, res.ETag = op.Person, etag(op.Person.Updated)
+		}
+	case "person.delete":
+		res.Status, err = removePerson(ctx, after, int(op.ID), "runBatch")
+	case "department.create", "department.update":
+		if op.Department == nil {
+			res.Status, err = http.StatusBadRequest, errors.New("missing department")
+			break
+		}
+		var t time.Time
+		if op.Op == "create" {
+			t, res.Status, err = addDepartment(ctx, after, op.Department)
+		} else {
+			t, res.Status, err = changeDepartment(ctx, after, int(op.ID), h, op.Department)
+		}
+		if err == nil {
+			res.Department, res.ETag = op.Department, etag(t)
+		}
+	case "department.delete":
+		res.Status, err = removeDepartment(ctx, after, int(op.ID))
+	default:
+		res.Status, err = http.StatusBadRequest, fmt.Errorf("unknown operation %q on %q", op.Op, op.Type)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// rollbackAll rolls back the transaction of ctx, along with any transactions
+// nested in it which a failed operation left open.
+func rollbackAll(ctx *ql.TCtx) {
+	for {
+		if _, _, err := db.Execute(ctx, qRollback); err != nil {
+			return
+		}
+	}
+}
+
+// readCtx is the transaction context of queries which only read. ql makes a
+// query in the nil context wait for an open transaction to be committed or
+// rolled back, while one in a context of its own fails.
+var readCtx *ql.TCtx
+
+// inTransaction runs f in a transaction, which is committed if f succeeds
+// and rolled back if not. What f adds to be done after commit is run after
+// commit. On failure it returns the HTTP status code to respond with.
+func inTransaction(function string, f func(ctx *ql.TCtx, after *afterCommit) (int, error)) (int, error) {
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qBegin); err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	var after afterCommit
+	if status, err := f(ctx, &after); err != nil {
+		rollbackAll(ctx)
+		return status, err
+	}
+	if _, _, err := db.Execute(ctx, qCommit); err != nil {
+		rollbackAll(ctx)
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+	after.run()
+	return http.StatusOK, nil
+}
+
+// POST /batch
+func runBatch(u *url.URL, h http.Header, req *batchRequest) (int, http.Header, *batchResponse, error) {
+	if len(req.Operations) == 0 {
+		return http.StatusBadRequest, nil, nil, errors.New("batch has no operations")
+	}
+	if len(req.Operations) > MaxBatchOperations {
+		return http.StatusBadRequest, nil, nil, fmt.Errorf("batch cannot have more than %d operations", MaxBatchOperations)
+	}
+
+	res := &batchResponse{Results: []*batchResult{}}
+	status, err := inTransaction("runBatch", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		for _, op := range req.Operations {
+			r := runBatchOp(ctx, after, op)
+			res.Results = append(res.Results, r)
+			if r.Error != "" {
+				return r.Status, errors.New(r.Error)
+			}
+		}
+		return http.StatusOK, nil
+	})
+	if err != nil {
+		if n := len(res.Results); n > 0 && res.Results[n-1].Error != "" {
+			log.Info("batch rolled back", log.Ctx{"operations": len(req.Operations), "failed": n - 1, "error": err.Error()})
+			return status, nil, res, nil
+		}
+		return status, nil, nil, err
+	}
+	res.Committed = true
+
+	log.Info("batch committed", log.Ctx{"operations": len(req.Operations)})
+	return http.StatusOK, nil, res, nil
+}
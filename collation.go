@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/cznic/ql"
+)
+
+var (
+	qGetSortName     = ql.MustCompile(`SELECT Person, Name FROM PersonSortName WHERE Person == $1;`)
+	qGetAllSortNames = ql.MustCompile(`SELECT Person, Name FROM PersonSortName;`)
+	qInsertSortName  = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO PersonSortName VALUES($1, $2); COMMIT;`)
+	qDeleteSortName  = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM PersonSortName WHERE Person == $1; COMMIT;`)
+)
+
+// foldings are the letters sorted as other letters, in Norwegian order.
+var foldings = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'ç': "c", 'ć': "c", 'č': "c",
+	'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i",
+	'ł': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n", 'ŋ': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ō': "o",
+	'ř': "r",
+	'š': "s", 'ś': "s", 'ş': "s",
+	'ť': "t", 'ŧ': "t",
+	'ù': "u", 'ú': "u", 'û': "u", 'ū': "u", 'ů': "u",
+	'ü': "y", 'ű': "y", 'ý': "y", 'ÿ': "y",
+	'ž': "z", 'ź': "z", 'ż': "z",
+	'ä': "æ", 'ö': "ø", 'ő': "ø",
+	'ß': "ss", 'þ': "th",
+}
+
+// collationWeight returns the weight by which the letter or digit is
+// sorted, ranking æ, ø and å after z.
+func collationWeight(r rune) (byte, bool) {
+	switch {
+	case r >= '0' && r <= '9':
+		return 0x10 + byte(r-'0'), true
+	case r >= 'a' && r <= 'z':
+		return 0x20 + byte(r-'a'), true
+	case r == 'æ':
+		return 0x3a, true
+	case r == 'ø':
+		return 0x3b, true
+	case r == 'å':
+		return 0x3c, true
+	}
+	return 0, false
+}
+
+// collationKey returns the key by which s is sorted in Norwegian order: case
+// and accents are ignored, and æ, ø and å, as well as aa for å, come after z.
+// Words are separated by spaces, hyphens or commas; other punctuation is
+// ignored, and other letters come last. Strings equal but for case and
+// accents are sorted by their bytes.
+func collationKey(s string) string {
+	var b []byte
+	sep := false
+	rs := []rune(strings.ToLower(s))
+	for i := 0; i < len(rs); i++ {
+		r := rs[i]
+		if unicode.IsSpace(r) || r == '-' || r == ',' {
+			sep = true
+			continue
+		}
+		if r == 'a' && i+1 < len(rs) && rs[i+1] == 'a' {
+			r = 'å'
+			i++
+		}
+		folded, ok := foldings[r]
+		if !ok {
+			folded = string(r)
+		}
+		for _, r := range folded {
+			var w []byte
+			if weight, ok := collationWeight(r); ok {
+				w = []byte{weight}
+			} else if unicode.IsLetter(r) {
+				w = []byte(string(r))
+			} else {
+				continue
+			}
+			if sep && len(b) > 0 {
+				b = append(b, 0x01)
+			}
+			b = append(b, w...)
+			sep = false
+		}
+	}
+	return string(b) + "\x00" + s
+}
+
+// sortByName sorts the persons by name, in Norwegian order.
+func sortByName(ps []*person) {
+	l := &listing{
+		keys: make([]string, len(ps)),
+		swap: func(i, j int) { ps[i], ps[j] = ps[j], ps[i] },
+	}
+	for i, p := range ps {
+		l.keys[i] = personKeys["name"](p)
+	}
+	sort.Sort(l)
+}
+
+// defaultSortName returns the name with the family name, taken to be the last
+// word, first.
+func defaultSortName(name string) string {
+	given, family := splitName(name)
+	if given == "" {
+		return family
+	}
+	return family + ", " + given
+}
+
+// prepareSortName tidies the sort name of a person being created or
+// updated. If SortName is missing, it defaults to the name with the family
+// name first, unless old has another sort name set. A renamed person's
+// default sort name follows the name, even if sent back unchanged.
+func prepareSortName(p, old *person) {
+	p.SortName = strings.TrimSpace(p.SortName)
+	if p.SortName == defaultSortName(old.Name) && p.Name != old.Name {
+		p.SortName = ""
+	}
+	if p.SortName != "" {
+		return
+	}
+	if old.SortName != "" && old.SortName != defaultSortName(old.Name) {
+		p.SortName = old.SortName
+		return
+	}
+	p.SortName = defaultSortName(p.Name)
+}
+
+// savePersonSortName replaces the sort name of the person.
+func savePersonSortName(ctx *ql.TCtx, id int64, name string) (err error) {
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeleteSortName, id); err != nil {
+		return err
+	}
+	if _, _, err = db.Execute(ctx, qInsertSortName, id, name); err != nil {
+		return err
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// personSortNames returns the sort names stored of the given person, or of
+// all persons, by person ID.
+func personSortNames(ctx *ql.TCtx, ps ...*person) (map[int64]string, error) {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetSortName, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllSortNames)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int64]string)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		res[data[0].(int64)] = data[1].(string)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setPersonSortNames fills in the sort names of the given persons. Persons
+// not updated since sort names were stored get the default one.
+func setPersonSortNames(ctx *ql.TCtx, ps ...*person) error {
+	names, err := personSortNames(ctx, ps...)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		var ok bool
+		if p.SortName, ok = names[p.ID]; !ok {
+			p.SortName = defaultSortName(p.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cznic/ql"
+)
+
+var (
+	qGetContacts         = ql.MustCompile(`SELECT Person, Kind, Value, Public, Preferred, Position FROM Contact WHERE Person == $1 ORDER BY Position ASC;`)
+	qGetAllContacts      = ql.MustCompile(`SELECT Person, Kind, Value, Public, Preferred, Position FROM Contact ORDER BY Person, Position ASC;`)
+	qInsertContact       = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Contact VALUES($1, $2, $3, $4, $5, $6); COMMIT;`)
+	qDeleteContacts      = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Contact WHERE Person == $1; COMMIT;`)
+	qSetPersonContact    = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Person SET Email = $1, Phone = $2 WHERE id() == $3; COMMIT;`)
+	qPersonContacts      = ql.MustCompile(`SELECT id(), Email, Phone FROM Person;`)
+	qPersonsWithContacts = ql.MustCompile(`SELECT DISTINCT Person FROM Contact;`)
+
+	phoneNumbers = regexp.MustCompile(`^\+?[0-9][0-9 ().-]*$`)
+)
+
+// Kinds of contact points
+const (
+	ContactMobile      = "mobile"
+	ContactDesk        = "desk"
+	ContactSwitchboard = "switchboard"
+	ContactWork        = "work"   // personal work mailbox
+	ContactShared      = "shared" // shared mailbox
+)
+
+var (
+	phoneKinds = []string{ContactMobile, ContactDesk, ContactSwitchboard}
+	emailKinds = []string{ContactWork, ContactShared}
+)
+
+// contact is a phone number or email address of a person.
+type contact struct {
+	Person    int64 `json:"-"`
+	Kind      string
+	Value     string
+	Public    bool  // shown to everyone, not only internally
+	Preferred bool  // the preferred phone number or email address
+	Position  int64 `json:"-"` // position in the list, starting at 0
+}
+
+func isPhoneKind(kind string) bool {
+	for _, k := range phoneKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// phoneKind guesses the kind of a phone number: Norwegian mobile numbers
+// start with 4 or 9.
+func phoneKind(number string) string {
+	digits := strings.Map(func(r rune) rune {
+		if r < '0' || r > '9' {
+			return -1
+		}
+		return r
+	}, number)
+	if len(digits) == 10 && strings.HasPrefix(digits, "47") {
+		digits = digits[2:]
+	}
+	if len(digits) == 8 && (digits[0] == '4' || digits[0] == '9') {
+		return ContactMobile
+	}
+	return ContactDesk
+}
+
+// splitContacts splits a phone or email value, as it used to be stored in
+// Person, into public contact points. Several values were separated by
+// slashes or commas; the first becomes the preferred one.
+func splitContacts(value string, phone bool) []*contact {
+	res := []*contact{}
+	for _, v := range strings.FieldsFunc(value, func(r rune) bool { return r == '/' || r == ',' }) {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		c := &contact{Kind: ContactWork, Value: v, Public: true}
+		if phone {
+			c.Kind = phoneKind(v)
+		}
+		res = append(res, c)
+	}
+	if len(res) > 0 {
+		res[0].Preferred = true
+	}
+	return res
+}
+
+// preferredContact returns the value of the preferred contact point, or ""
+// if the list is empty.
+func preferredContact(cs []*contact) string {
+	for _, c := range cs {
+		if c.Preferred {
+			return c.Value
+		}
+	}
+	if len(cs) > 0 {
+		return cs[0].Value
+	}
+	return ""
+}
+
+// mergeContact returns the contact points after a client which only knows
+// the single Phone or Email value changed it from old to value: the
+// preferred contact point is replaced by the new value(s). Clients which
+// are not shown internal contact points see a public one as the preferred;
+// sending it back leaves the contact points unchanged.
+func mergeContact(cs []*contact, value, old string, phone bool) []*contact {
+	if value == old {
+		return cs
+	}
+	for _, c := range cs {
+		if c.Value == value {
+			return cs
+		}
+	}
+	res := splitContacts(value, phone)
+	for _, c := range cs {
+		if !c.Preferred {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// validateContacts checks a list of phone numbers or email addresses, and
+// makes sure exactly one of them is preferred.
+func validateContacts(cs []*contact, phone bool) error {
+	what, kinds := "email", emailKinds
+	if phone {
+		what, kinds = "phone", phoneKinds
+	}
+
+	preferred := 0
+	for _, c := range cs {
+		c.Value = strings.TrimSpace(c.Value)
+		ok := false
+		for _, k := range kinds {
+			ok = ok || c.Kind == k
+		}
+		if !ok {
+			return fmt.Errorf("%s kind must be one of: %s", what, strings.Join(kinds, ", "))
+		}
+		if phone && !phoneNumbers.MatchString(c.Value) {
+			return fmt.Errorf("invalid phone number: %q", c.Value)
+		}
+		if !phone && (strings.Count(c.Value, "@") != 1 ||
+			strings.HasPrefix(c.Value, "@") || strings.HasSuffix(c.Value, "@") ||
+			strings.ContainsAny(c.Value, " \t<>")) {
+			return fmt.Errorf("invalid email address: %q", c.Value)
+		}
+		if c.Preferred {
+			preferred++
+		}
+	}
+	if preferred > 1 {
+		return fmt.Errorf("only one %s can be preferred", what)
+	}
+	if preferred == 0 && len(cs) > 0 {
+		cs[0].Preferred = true
+	}
+	return nil
+}
+
+// prepareContacts validates the phone numbers and email addresses of a
+// person being created or updated, and sets Phone and Email to the
+// preferred ones. If Phones or Emails is missing, the contact points of old
+// are kept, with any change of Phone or Email applied.
+func prepareContacts(p, old *person) error {
+	if p.Phones == nil {
+		p.Phones = mergeContact(old.Phones, p.Phone, old.Phone, true)
+	}
+	if p.Emails == nil {
+		p.Emails = mergeContact(old.Emails, p.Email, old.Email, false)
+	}
+	if err := validateContacts(p.Phones, true); err != nil {
+		return err
+	}
+	if err := validateContacts(p.Emails, false); err != nil {
+		return err
+	}
+	p.Phone = preferredContact(p.Phones)
+	p.Email = preferredContact(p.Emails)
+	return nil
+}
+
+// savePersonContacts replaces the phone numbers and email addresses of a
+// person, and sets the person's Phone and Email to the preferred ones.
+func savePersonContacts(ctx *ql.TCtx, id int64, phones, emails []*contact) (err error) {
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeleteContacts, id); err != nil {
+		return err
+	}
+	for i, c := range append(append([]*contact{}, phones...), emails...) {
+		c.Person = id
+		c.Position = int64(i)
+		if _, _, err = db.Execute(ctx, qInsertContact, ql.MustMarshal(c)...); err != nil {
+			return err
+		}
+	}
+	if _, _, err = db.Execute(ctx, qSetPersonContact, preferredContact(emails), preferredContact(phones), id); err != nil {
+		return err
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// setPersonContacts fills in the phone numbers and email addresses of the
+// given persons.
+func setPersonContacts(ctx *ql.TCtx, ps ...*person) error {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetContacts, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllContacts)
+	}
+	if err != nil {
+		return err
+	}
+
+	byPerson := make(map[int64][]*contact)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		c := &contact{}
+		if err := ql.Unmarshal(c, data); err != nil {
+			return false, err
+		}
+		byPerson[c.Person] = append(byPerson[c.Person], c)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		p.Phones, p.Emails = []*contact{}, []*contact{}
+		for _, c := range byPerson[p.ID] {
+			if isPhoneKind(c.Kind) {
+				p.Phones = append(p.Phones, c)
+			} else {
+				p.Emails = append(p.Emails, c)
+			}
+		}
+	}
+	return nil
+}
+
+// publicContacts returns the public contact points in cs.
+func publicContacts(cs []*contact) []*contact {
+	res := []*contact{}
+	for _, c := range cs {
+		if c.Public {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// hideInternalContacts removes the non-public phone numbers and email
+// addresses of persons, so that Phone and Email are the preferred public
+// ones.
+func hideInternalContacts(ps ...*person) {
+	for _, p := range ps {
+		p.Phones = publicContacts(p.Phones)
+		p.Emails = publicContacts(p.Emails)
+		p.Phone = preferredContact(p.Phones)
+		p.Email = preferredContact(p.Emails)
+	}
+}
+
+// contactsIndexText returns the public phone numbers and email addresses of
+// a person, to be searchable.
+func contactsIndexText(p *person) string {
+	var texts []string
+	for _, c := range publicContacts(append(append([]*contact{}, p.Phones...), p.Emails...)) {
+		texts = append(texts, c.Value)
+	}
+	return strings.Join(texts, " ")
+}
+
+// migrateContacts moves the phone numbers and email addresses of persons
+// who have none in the Contact table from Person.Phone and Person.Email,
+// where several values used to be separated by slashes.
+func migrateContacts() (int, error) {
+	ctx := ql.NewRWCtx()
+	rs, _, err := db.Execute(ctx, qPersonsWithContacts)
+	if err != nil {
+		return 0, err
+	}
+	migrated := make(map[int64]bool)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		migrated[data[0].(int64)] = true
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	rs, _, err = db.Execute(ctx, qPersonContacts)
+	if err != nil {
+		return 0, err
+	}
+	var ps []*person
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		p := &person{ID: data[0].(int64), Email: data[1].(string), Phone: data[2].(string)}
+		if !migrated[p.ID] && (p.Email != "" || p.Phone != "") {
+			ps = append(ps, p)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for _, p := range ps {
+		if err := savePersonContacts(ctx, p.ID, splitContacts(p.Phone, true), splitContacts(p.Email, false)); err != nil {
+			return 0, err
+		}
+	}
+	return len(ps), nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetEmployment     = ql.MustCompile(`SELECT Person, Start, End FROM Employment WHERE Person == $1;`)
+	qGetAllEmployments = ql.MustCompile(`SELECT Person, Start, End FROM Employment;`)
+	qInsertEmployment  = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Employment VALUES($1, $2, $3); COMMIT;`)
+	qDeleteEmployment  = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Employment WHERE Person == $1; COMMIT;`)
+)
+
+// employment is the period a person is employed. Persons are only listed
+// while employed.
+type employment struct {
+	Person int64  `json:"-"`
+	Start  string // first day, as 2006-01-02; "" if not known
+	End    string // last day, as 2006-01-02; "" if not known
+}
+
+// current reports whether the person is employed on the given day.
+func (e *employment) current(day string) bool {
+	return (e.Start == "" || e.Start <= day) && (e.End == "" || e.End >= day)
+}
+
+// showInactive reports whether persons who are not currently employed are
+// asked for, with the parameter inactive=true.
+func showInactive(u *url.URL) bool {
+	show, _ := strconv.ParseBool(u.Query().Get("inactive"))
+	return show
+}
+
+// prepareEmployment validates the employment period of a person being created
+// or updated. If Employment is missing, the period of old is kept.
+func prepareEmployment(p, old *person) error {
+	if p.Employment == nil {
+		p.Employment = old.Employment
+	}
+	if p.Employment == nil {
+		p.Employment = &employment{}
+	}
+	e := p.Employment
+	e.Start, e.End = strings.TrimSpace(e.Start), strings.TrimSpace(e.End)
+	for _, d := range []string{e.Start, e.End} {
+		if d == "" {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, d); err != nil {
+			return fmt.Errorf("dates must be given as YYYY-MM-DD, got %q", d)
+		}
+	}
+	if e.Start != "" && e.End != "" && e.End < e.Start {
+		return errors.New("employment cannot end before it starts")
+	}
+	return nil
+}
+
+// savePersonEmployment replaces the employment period of a person.
+func savePersonEmployment(ctx *ql.TCtx, id int64, e *employment) (err error) {
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeleteEmployment, id); err != nil {
+		return err
+	}
+	if e != nil && (e.Start != "" || e.End != "") {
+		e.Person = id
+		if _, _, err = db.Execute(ctx, qInsertEmployment, ql.MustMarshal(e)...); err != nil {
+			return err
+		}
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// personEmployments returns the employment periods of the given person, or
+// of all persons, by person ID. Persons without a known period are missing.
+func personEmployments(ctx *ql.TCtx, ps ...*person) (map[int64]*employment, error) {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetEmployment, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllEmployments)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int64]*employment)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		e := &employment{}
+		if err := ql.Unmarshal(e, data); err != nil {
+			return false, err
+		}
+		res[e.Person] = e
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setPersonEmployments fills in the employment periods of the given persons.
+func setPersonEmployments(ctx *ql.TCtx, ps ...*person) error {
+	es, err := personEmployments(ctx, ps...)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		p.Employment = es[p.ID]
+		if p.Employment == nil {
+			p.Employment = &employment{}
+		}
+	}
+	return nil
+}
+
+// inactivePersons returns the IDs of the persons who are not employed today,
+// or none if the request asks for them with inactive=true.
+func inactivePersons(ctx *ql.TCtx, u *url.URL) (map[int64]bool, error) {
+	res := make(map[int64]bool)
+	if showInactive(u) {
+		return res, nil
+	}
+	es, err := personEmployments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	day := today()
+	for id, e := range es {
+		if !e.current(day) {
+			res[id] = true
+		}
+	}
+	return res, nil
+}
+
+// excludeHits returns the hits which are not in ids.
+func excludeHits(hits []int, ids map[int64]bool) []int {
+	res := []int{}
+	for _, id := range hits {
+		if !ids[int64(id)] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// departedPerson is a person whose employment ended long enough ago to be
+// purged.
+type departedPerson struct {
+	ID   int64
+	Name string
+	End  string
+}
+
+// purgeReport is the result of a purge of departed persons.
+type purgeReport struct {
+	DryRun   bool
+	Days     int
+	Departed []departedPerson // persons whose employment ended more than Days days ago
+	Removed  []int64          // removed persons; empty on dry run
+}
+
+// purgeDeparted deletes the persons whose employment ended more than days
+// days ago. With dryRun, it only reports who would be deleted.
+func purgeDeparted(days int, dryRun bool) (*purgeReport, error) {
+	ctx := ql.NewRWCtx()
+	es, err := personEmployments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &purgeReport{DryRun: dryRun, Days: days, Departed: []departedPerson{}, Removed: []int64{}}
+	cutoff := time.Now().AddDate(0, 0, -days).Format(dateLayout)
+	for id, e := range es {
+		if e.End == "" || e.End >= cutoff {
+			continue
+		}
+		p, err := fetchPerson(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			continue
+		}
+		report.Departed = append(report.Departed, departedPerson{ID: id, Name: p.Name, End: e.End})
+		if dryRun {
+			continue
+		}
+		var after afterCommit
+		if _, err := removePerson(ctx, &after, int(id), "purgeDeparted"); err != nil {
+			continue
+		}
+		after.run()
+		report.Removed = append(report.Removed, id)
+	}
+
+	log.Info("departed persons purged", log.Ctx{"dryRun": dryRun, "days": days, "departed": len(report.Departed), "removed": len(report.Removed)})
+	return report, nil
+}
+
+// purgeDepartedDaily runs purgeDeparted once a day, according to the
+// PurgeAfterDays setting.
+func purgeDepartedDaily(days int) {
+	for {
+		if _, err := purgeDeparted(days, false); err != nil {
+			log.Error("failed to purge departed persons", log.Ctx{"error": err.Error()})
+		}
+		time.Sleep(24 * time.Hour)
+	}
+}
+
+// POST /persons/purge?days=N&dryrun=true
+func purgePersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *purgeReport, error) {
+	days, err := strconv.Atoi(u.Query().Get("days"))
+	if err != nil || days < 0 {
+		return http.StatusBadRequest, nil, nil, errors.New("days parameter must be a non-negative integer")
+	}
+
+	// Only delete persons when explicitly asked to.
+	dryRun := true
+	if s := u.Query().Get("dryrun"); s != "" {
+		dryRun, err = strconv.ParseBool(s)
+		if err != nil {
+			return http.StatusBadRequest, nil, nil, errors.New("dryrun parameter must be a boolean")
+		}
+	}
+
+	report, err := purgeDeparted(days, dryRun)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "purgePersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	return http.StatusOK, nil, report, nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cznic/ql"
+)
+
+var (
+	qGetPersonUpdated  = ql.MustCompile(`SELECT Updated FROM Person WHERE id() == $1;`)
+	qGetDeptUpdated    = ql.MustCompile(`SELECT Updated FROM DepartmentUpdated WHERE Department == $1;`)
+	qSetDeptUpdated    = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM DepartmentUpdated WHERE Department == $1; INSERT INTO DepartmentUpdated VALUES($1, $2); COMMIT;`)
+	qDeleteDeptUpdated = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM DepartmentUpdated WHERE Department == $1; COMMIT;`)
+)
+
+// errPreconditionFailed is returned when an update is based on an old
+// version, as given by If-Match.
+var errPreconditionFailed = errors.New("changed by someone else since it was fetched; fetch it again and retry")
+
+// etag returns the entity tag of the version last modified at t.
+func etag(t time.Time) string {
+	return `"` + strconv.FormatInt(t.UnixNano(), 36) + `"`
+}
+
+// versionHeaders returns the ETag and Last-Modified headers of the version
+// last modified at t. Departments not modified since their modification time
+// was recorded have no Last-Modified.
+func versionHeaders(t time.Time) http.Header {
+	h := http.Header{"Etag": {etag(t)}}
+	if !t.IsZero() {
+		h.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	}
+	return h
+}
+
+// ifMatch reports whether the current version, with the entity tag current,
+// is one of those given by If-Match. A missing If-Match matches any version.
+func ifMatch(h http.Header, current string) bool {
+	v := h.Get("If-Match")
+	if v == "" {
+		return true
+	}
+	for _, tag := range strings.Split(v, ",") {
+		// Weak tags never match, as If-Match uses strong comparison.
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+// personUpdated returns when the person was last modified.
+func personUpdated(ctx *ql.TCtx, id int64) (time.Time, error) {
+	rs, _, err := db.Execute(ctx, qGetPersonUpdated, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	row, err := rs[0].FirstRow()
+	if err != nil || row == nil {
+		return time.Time{}, err
+	}
+	return row[0].(time.Time), nil
+}
+
+// deptUpdated returns when the department was last modified, or the zero
+// time if it hasn't been modified since this was recorded.
+func deptUpdated(ctx *ql.TCtx, id int64) (time.Time, error) {
+	rs, _, err := db.Execute(ctx, qGetDeptUpdated, id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	row, err := rs[0].FirstRow()
+	if err != nil || row == nil {
+		return time.Time{}, err
+	}
+	return row[0].(time.Time), nil
+}
+
+// touchDept records that the department was modified now, and returns the
+// time.
+func touchDept(ctx *ql.TCtx, id int64) (time.Time, error) {
+	now := time.Now()
+	_, _, err := db.Execute(ctx, qSetDeptUpdated, id, now)
+	return now, err
+}
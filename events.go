@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+const (
+	// MaxEventHistory is the number of events kept for clients resuming
+	// the event stream.
+	MaxEventHistory = 1000
+
+	// EventHeartbeat is how often an idle event stream is sent a comment,
+	// to keep proxies from closing it.
+	EventHeartbeat = 30 * time.Second
+
+	// eventBuffer is the number of events queued for a client before it is
+	// considered too slow and disconnected.
+	eventBuffer = 64
+)
+
+// streamEvent is an event sent to the clients of the event stream.
+type streamEvent struct {
+	ID       int64
+	Type     string
+	Internal []byte // the event, as sent to webhooks
+	Public   []byte // the event, without internal fields and contacts
+}
+
+// eventBroker broadcasts events to the clients of the event stream, and keeps
+// the latest events so that clients can resume after reconnecting.
+type eventBroker struct {
+	mu      sync.Mutex
+	lastID  int64
+	history []*streamEvent // oldest first
+	clients map[chan *streamEvent]bool
+}
+
+// newEventBroker returns a broker whose event IDs start at the current time
+// in milliseconds, so that IDs keep increasing across restarts.
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		lastID:  time.Now().UnixNano() / int64(time.Millisecond) * 1000,
+		clients: make(map[chan *streamEvent]bool),
+	}
+}
+
+var events = newEventBroker()
+
+// publish sends the event to all clients. Clients which are too slow to keep
+// up are disconnected; they can resume with the last event they got.
+func (b *eventBroker) publish(typ string, internal, public []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	ev := &streamEvent{ID: b.lastID, Type: typ, Internal: internal, Public: public}
+	b.history = append(b.history, ev)
+	if len(b.history) > MaxEventHistory {
+		b.history = b.history[len(b.history)-MaxEventHistory:]
+	}
+	for ch := range b.clients {
+		select {
+		case ch <- ev:
+		default:
+			delete(b.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of new events, and the events after lastID
+// which the client missed. If lastID is too old for the missed events to be
+// known, complete is false.
+func (b *eventBroker) subscribe(lastID int64, resume bool) (ch chan *streamEvent, backlog []*streamEvent, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch = make(chan *streamEvent, eventBuffer)
+	b.clients[ch] = true
+	if !resume || lastID >= b.lastID {
+		return ch, nil, true
+	}
+	if len(b.history) == 0 || lastID < b.history[0].ID-1 {
+		return ch, nil, false
+	}
+	for _, ev := range b.history {
+		if ev.ID > lastID {
+			backlog = append(backlog, ev)
+		}
+	}
+	return ch, backlog, true
+}
+
+// unsubscribe stops sending events to the channel.
+func (b *eventBroker) unsubscribe(ch chan *streamEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.clients[ch] {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+// publicEvent returns the event as seen by the public, with the internal
+// fields and contacts of persons removed.
+func publicEvent(ev event) event {
+	p, ok := ev.Data.(*person)
+	if !ok || p == nil {
+		return ev
+	}
+	cp := *p
+	cp.Fields = make(map[string]string, len(p.Fields))
+	for k, v := range p.Fields {
+		cp.Fields[k] = v
+	}
+	hideInternal(&cp)
+	ev.Data = &cp
+	return ev
+}
+
+// streamEvents sends the event to the clients of the event stream.
+func streamEvents(ev event, payload []byte) {
+	public := payload
+	if _, ok := ev.Data.(*person); ok {
+		var err error
+		if public, err = json.Marshal(publicEvent(ev)); err != nil {
+			log.Error("failed to marshal event", log.Ctx{"event": ev.Type, "error": err.Error()})
+			return
+		}
+	}
+	events.publish(ev.Type, payload, public)
+}
+
+// writeStreamEvent writes the event in the text/event-stream format.
+func writeStreamEvent(w http.ResponseWriter, ev *streamEvent, internal bool) error {
+	data := ev.Public
+	if internal {
+		data = ev.Internal
+	}
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data)
+	return err
+}
+
+// GET /events
+//
+// A client reconnecting with the header Last-Event-ID, or the parameter
+// lastEventId, is first sent the events it missed. If they are no longer
+// known, it is sent a "reset" event, and should reload everything.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	lastStr := r.Header.Get("Last-Event-ID")
+	if lastStr == "" {
+		lastStr = r.URL.Query().Get("lastEventId")
+	}
+	var lastID int64
+	if lastStr != "" {
+		var err error
+		if lastID, err = strconv.ParseInt(lastStr, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("last event ID must be an integer"))
+			return
+		}
+	}
+	internal := showInternal(r.URL)
+
+	ch, backlog, complete := events.subscribe(lastID, lastStr != "")
+	defer events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", 5000)
+	if !complete {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, ev := range backlog {
+		if err := writeStreamEvent(w, ev, internal); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(EventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				// Too slow; the client reconnects and resumes.
+				return
+			}
+			if err := writeStreamEvent(w, ev, internal); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// departmentNames returns the names of all departments, by ID.
+func departmentNames(ctx *ql.TCtx) (map[int64]string, error) {
+	rs, _, err := db.Run(ctx, qGetAllDepts)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[int64]string)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		d := department{}
+		if err := ql.Unmarshal(&d, data); err != nil {
+			return false, err
+		}
+		names[d.ID] = d.Name
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// formatContacts formats contact points as "value (kind)", separated by
+// semicolons. The preferred one is listed first.
+func formatContacts(cs []*contact) string {
+	var res []string
+	for _, c := range cs {
+		s := fmt.Sprintf("%s (%s)", c.Value, c.Kind)
+		if c.Preferred {
+			res = append([]string{s}, res...)
+		} else {
+			res = append(res, s)
+		}
+	}
+	return strings.Join(res, "; ")
+}
+
+// GET /export/persons.csv
+//
+// exportPersons writes all persons as CSV, sorted by their sort name.
+// Internal information is included with the parameter internal=true.
+func exportPersons(w http.ResponseWriter, r *http.Request) {
+	internal := showInternal(r.URL)
+
+	ctx := readCtx
+	persons, err := allPersons(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "exportPersons", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+	depts, err := departmentNames(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "exportPersons", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+	if !internal {
+		hideInternal(persons...)
+	}
+
+	// Alphabetically, by family name first, in Norwegian order
+	l := &listing{
+		keys: make([]string, len(persons)),
+		swap: func(i, j int) { persons[i], persons[j] = persons[j], persons[i] },
+	}
+	for i, p := range persons {
+		l.keys[i] = collationKey(p.SortName) + "\x00" + idKey(p.ID)
+	}
+	sort.Sort(l)
+
+	var defs []*fieldDef
+	for _, d := range fields.all() {
+		if internal || d.Public {
+			defs = append(defs, d)
+		}
+	}
+
+	header := []string{"ID", "Name", "Department", "Role", "Email", "Phone", "Emails", "Phones", "Info", "Branch", "Building", "Floor", "Room"}
+	for _, d := range defs {
+		header = append(header, d.Label)
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="persons.csv"`)
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, p := range persons {
+		rec := []string{
+			strconv.FormatInt(p.ID, 10),
+			p.Name,
+			depts[p.Dept],
+			p.Role,
+			p.Email,
+			p.Phone,
+			formatContacts(p.Emails),
+			formatContacts(p.Phones),
+			p.Info,
+			p.Location.Branch,
+			p.Location.Building,
+			p.Location.Floor,
+			p.Location.Room,
+		}
+		for _, d := range defs {
+			rec = append(rec, p.Fields[d.Name])
+		}
+		cw.Write(rec)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Error("failed to write CSV", log.Ctx{"function": "exportPersons", "error": err.Error()})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetCreated        = ql.MustCompile(`SELECT Person, Created FROM PersonCreated WHERE Person == $1;`)
+	qGetAllCreated     = ql.MustCompile(`SELECT Person, Created FROM PersonCreated;`)
+	qInsertCreated     = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO PersonCreated VALUES($1, now()); COMMIT;`)
+	qMigrateCreated    = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO PersonCreated VALUES($1, $2); COMMIT;`)
+	qDeleteCreated     = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM PersonCreated WHERE Person == $1; COMMIT;`)
+	qPersonsUpdated    = ql.MustCompile(`SELECT id(), Updated FROM Person;`)
+	qPersonsWithCreate = ql.MustCompile(`SELECT DISTINCT Person FROM PersonCreated;`)
+)
+
+// MaxFeedEntries is the number of persons in a feed.
+const MaxFeedEntries = 50
+
+// setPersonCreated fills in when the given persons were created.
+func setPersonCreated(ctx *ql.TCtx, ps ...*person) error {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetCreated, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllCreated)
+	}
+	if err != nil {
+		return err
+	}
+
+	created := make(map[int64]time.Time)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		created[data[0].(int64)] = data[1].(time.Time)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	for _, p := range ps {
+		p.Created = created[p.ID]
+	}
+	return nil
+}
+
+// migrateCreated records the creation time of persons created before it was
+// stored. Their last update is the best guess.
+func migrateCreated() (int, error) {
+	ctx := ql.NewRWCtx()
+	rs, _, err := db.Execute(ctx, qPersonsWithCreate)
+	if err != nil {
+		return 0, err
+	}
+	migrated := make(map[int64]bool)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		migrated[data[0].(int64)] = true
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	rs, _, err = db.Execute(ctx, qPersonsUpdated)
+	if err != nil {
+		return 0, err
+	}
+	updated := make(map[int64]time.Time)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		if id := data[0].(int64); !migrated[id] {
+			updated[id] = data[1].(time.Time)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for id, t := range updated {
+		if _, _, err := db.Execute(ctx, qMigrateCreated, id, t); err != nil {
+			return 0, err
+		}
+	}
+	return len(updated), nil
+}
+
+// atomFeed is an Atom feed (RFC 4287).
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomAuthor  `xml:"author"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Link      []atomLink `xml:"link"`
+	Summary   string     `xml:"summary,omitempty"`
+}
+
+// personFeed returns the Atom feed of the given persons. The time of each
+// entry is given by when.
+func personFeed(baseURL, path, title string, ps []*person, depts map[int64]string, when func(*person) time.Time) *atomFeed {
+	feed := &atomFeed{
+		ID:      baseURL + path,
+		Title:   title,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Author:  atomAuthor{Name: "Folk"},
+		Link:    []atomLink{{Rel: "self", Href: baseURL + path, Type: "application/atom+xml"}},
+		Entries: []atomEntry{},
+	}
+	if len(ps) > 0 {
+		feed.Updated = when(ps[0]).UTC().Format(time.RFC3339)
+	}
+	for _, p := range ps {
+		var summary []string
+		for _, m := range p.Memberships {
+			s := depts[m.Dept]
+			if m.Role != "" {
+				s = m.Role + ", " + s
+			}
+			summary = append(summary, s)
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        fmt.Sprintf("urn:folk:person:%d", p.ID),
+			Title:     p.Name,
+			Published: p.Created.UTC().Format(time.RFC3339),
+			Updated:   when(p).UTC().Format(time.RFC3339),
+			Link:      []atomLink{{Rel: "alternate", Href: fmt.Sprintf("%s/api/person/%d", baseURL, p.ID), Type: "application/json"}},
+			Summary:   strings.Join(summary, "; "),
+		})
+	}
+	return feed
+}
+
+type personsByTime struct {
+	ps   []*person
+	when func(*person) time.Time
+}
+
+func (s personsByTime) Len() int           { return len(s.ps) }
+func (s personsByTime) Swap(i, j int)      { s.ps[i], s.ps[j] = s.ps[j], s.ps[i] }
+func (s personsByTime) Less(i, j int) bool { return s.when(s.ps[i]).After(s.when(s.ps[j])) }
+
+// feedHandler returns a handler serving an Atom feed of the persons most
+// recently created or updated, as given by when. Only persons who are
+// employed are included, and only the members of a department with the
+// parameter dept.
+func feedHandler(path, title string, when func(*person) time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := readCtx
+		persons, err := allPersons(ctx)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "feedHandler", "feed": path, "error": err.Error()})
+			writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+			return
+		}
+		depts, err := departmentNames(ctx)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "feedHandler", "feed": path, "error": err.Error()})
+			writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+			return
+		}
+
+		var members map[int64]bool
+		if deptStr := r.URL.Query().Get("dept"); deptStr != "" {
+			dept, err := strconv.Atoi(deptStr)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, errors.New("dept parameter must be an integer"))
+				return
+			}
+			if members, err = deptMembers(ctx, int64(dept)); err != nil {
+				log.Error("database query failed", log.Ctx{"function": "feedHandler", "feed": path, "error": err.Error()})
+				writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+				return
+			}
+		}
+
+		day := today()
+		var ps []*person
+		for _, p := range persons {
+			if (members == nil || members[p.ID]) && p.Employment.current(day) {
+				ps = append(ps, p)
+			}
+		}
+		sort.Sort(personsByTime{ps, when})
+		if len(ps) > MaxFeedEntries {
+			ps = ps[:MaxFeedEntries]
+		}
+		hideInternal(ps...)
+
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		self := path
+		if r.URL.RawQuery != "" {
+			self += "?" + r.URL.RawQuery
+		}
+		feed := personFeed(scheme+"://"+r.Host, self, title, ps, depts, when)
+
+		w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+		w.Write([]byte(xml.Header))
+		if err := xml.NewEncoder(w).Encode(feed); err != nil {
+			log.Error("failed to write feed", log.Ctx{"function": "feedHandler", "feed": self, "error": err.Error()})
+		}
+	}
+}
+
+// GET /feeds/new.atom
+var newPersonsFeed = feedHandler("/feeds/new.atom", "Nye kolleger", func(p *person) time.Time { return p.Created })
+
+// GET /feeds/updated.atom
+var updatedPersonsFeed = feedHandler("/feeds/updated.atom", "Oppdaterte kolleger", func(p *person) time.Time { return p.Updated })
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetAllFieldDefs   = ql.MustCompile(`SELECT id(), Name, Label, Type, OptionList, Required, Public, Indexed FROM FieldDef ORDER BY id() ASC;`)
+	qInsertFieldDef    = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO FieldDef VALUES($1, $2, $3, $4, $5, $6, $7); COMMIT;`)
+	qUpdateFieldDef    = ql.MustCompile(`BEGIN TRANSACTION; UPDATE FieldDef SET Name = $1, Label = $2, Type = $3, OptionList = $4, Required = $5, Public = $6, Indexed = $7 WHERE id() == $8; COMMIT;`)
+	qDeleteFieldDef    = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM FieldDef WHERE id() == $1; DELETE FROM FieldValue WHERE Field == $1; COMMIT;`)
+	qGetFieldValues    = ql.MustCompile(`SELECT Person, Field, Value FROM FieldValue WHERE Person == $1;`)
+	qGetAllFieldValues = ql.MustCompile(`SELECT Person, Field, Value FROM FieldValue;`)
+	qSetFieldValue     = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM FieldValue WHERE Person == $1 && Field == $2; INSERT INTO FieldValue VALUES($1, $2, $3); COMMIT;`)
+	qClearFieldValue   = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM FieldValue WHERE Person == $1 && Field == $2; COMMIT;`)
+	qDeleteFieldValues = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM FieldValue WHERE Person == $1; COMMIT;`)
+
+	fieldNames = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]*$`)
+	fields     = fieldDefs{} // definitions of custom person fields
+)
+
+// Custom field types
+const (
+	FieldText = "text"
+	FieldEnum = "enum"
+	FieldDate = "date"
+	FieldURL  = "url"
+)
+
+// fieldDef defines a custom person field.
+type fieldDef struct {
+	ID         int64
+	Name       string   // key in person.Fields
+	Label      string   // display name
+	Type       string   // text, enum, date or url
+	OptionList string   `json:"-"`
+	Required   bool     // persons must have a value
+	Public     bool     // shown to everyone, not only internally
+	Indexed    bool     // values are searchable
+	Options    []string `ql:"-"` // allowed values of enum fields
+}
+
+type fieldValue struct {
+	Person int64
+	Field  int64
+	Value  string
+}
+
+// fieldDefs is the cached list of custom field definitions.
+type fieldDefs struct {
+	sync.RWMutex
+	list []*fieldDef
+}
+
+func (f *fieldDefs) all() []*fieldDef {
+	f.RLock()
+	defer f.RUnlock()
+	return append([]*fieldDef{}, f.list...)
+}
+
+func (f *fieldDefs) byName(name string) *fieldDef {
+	f.RLock()
+	defer f.RUnlock()
+	for _, d := range f.list {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+func (f *fieldDefs) byID(id int64) *fieldDef {
+	f.RLock()
+	defer f.RUnlock()
+	for _, d := range f.list {
+		if d.ID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// loadFieldDefs reads the field definitions from the database.
+func loadFieldDefs() error {
+	ctx := readCtx
+	rs, _, err := db.Execute(ctx, qGetAllFieldDefs)
+	if err != nil {
+		return err
+	}
+
+	list := []*fieldDef{}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		d := &fieldDef{}
+		if err := ql.Unmarshal(d, data); err != nil {
+			return false, err
+		}
+		d.Options = []string{}
+		if d.OptionList != "" {
+			d.Options = strings.Split(d.OptionList, "\n")
+		}
+		list = append(list, d)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	fields.Lock()
+	fields.list = list
+	fields.Unlock()
+	return nil
+}
+
+// validate checks the definition of a field.
+func (d *fieldDef) validate() error {
+	if !fieldNames.MatchString(d.Name) {
+		return errors.New("field name must be a letter followed by letters, digits or underscores")
+	}
+	if old := fields.byName(d.Name); old != nil && old.ID != d.ID {
+		return errors.New("a field with same name allready exists")
+	}
+	if strings.TrimSpace(d.Label) == "" {
+		d.Label = d.Name
+	}
+	switch d.Type {
+	case FieldText, FieldDate, FieldURL:
+		d.Options = []string{}
+	case FieldEnum:
+		if len(d.Options) == 0 {
+			return errors.New("enum field must have options")
+		}
+		for _, o := range d.Options {
+			if strings.TrimSpace(o) == "" || strings.Contains(o, "\n") {
+				return errors.New("enum options cannot be empty or contain line breaks")
+			}
+		}
+	default:
+		return errors.New("field type must be one of text, enum, date or url")
+	}
+	d.OptionList = strings.Join(d.Options, "\n")
+	return nil
+}
+
+// validateValue checks that v is a valid value of the field.
+func (d *fieldDef) validateValue(v string) error {
+	switch d.Type {
+	case FieldEnum:
+		for _, o := range d.Options {
+			if v == o {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s must be one of: %s", d.Name, strings.Join(d.Options, ", "))
+	case FieldDate:
+		if _, err := time.Parse("2006-01-02", v); err != nil {
+			return fmt.Errorf("%s must be a date (YYYY-MM-DD)", d.Name)
+		}
+	case FieldURL:
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be a http or https URL", d.Name)
+		}
+	}
+	return nil
+}
+
+// validateFields checks the custom field values of a person being created,
+// with old nil, or updated. Fields not in values keep their old value; an
+// empty value clears the field. Only changed values are checked, so that a
+// person with values from before a field was made required, or had its type
+// or options changed, can still be updated.
+func validateFields(values, old map[string]string) error {
+	for name, v := range values {
+		d := fields.byName(name)
+		if d == nil {
+			return fmt.Errorf("unknown field: %s", name)
+		}
+		if v == "" || (old != nil && v == old[name]) {
+			continue
+		}
+		if err := d.validateValue(v); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range fields.all() {
+		if !d.Required {
+			continue
+		}
+		v, ok := values[d.Name]
+		if !ok {
+			v = old[d.Name]
+		}
+		if v == "" && (old == nil || old[d.Name] != "") {
+			return fmt.Errorf("%s is required", d.Name)
+		}
+	}
+	return nil
+}
+
+// saveFields stores the custom field values of a person. Fields not in
+// values are left as they are.
+func saveFields(ctx *ql.TCtx, id int64, values map[string]string) error {
+	for name, v := range values {
+		d := fields.byName(name)
+		if d == nil {
+			continue
+		}
+		var err error
+		if v == "" {
+			_, _, err = db.Execute(ctx, qClearFieldValue, id, d.ID)
+		} else {
+			_, _, err = db.Execute(ctx, qSetFieldValue, id, d.ID, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPersonFields fills in the custom field values of the given persons.
+func setPersonFields(ctx *ql.TCtx, ps ...*person) error {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetFieldValues, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllFieldValues)
+	}
+	if err != nil {
+		return err
+	}
+
+	byPerson := make(map[int64]map[string]string)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		fv := fieldValue{}
+		if err := ql.Unmarshal(&fv, data); err != nil {
+			return false, err
+		}
+		d := fields.byID(fv.Field)
+		if d == nil {
+			return true, nil
+		}
+		if byPerson[fv.Person] == nil {
+			byPerson[fv.Person] = make(map[string]string)
+		}
+		byPerson[fv.Person][d.Name] = fv.Value
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		p.Fields = byPerson[p.ID]
+		if p.Fields == nil {
+			p.Fields = make(map[string]string)
+		}
+	}
+	return nil
+}
+
+// fieldsIndexText returns the values of the searchable custom fields.
+func fieldsIndexText(values map[string]string) string {
+	var texts []string
+	for name, v := range values {
+		if d := fields.byName(name); d != nil && d.Indexed {
+			texts = append(texts, v)
+		}
+	}
+	sort.Strings(texts)
+	return strings.Join(texts, " ")
+}
+
+// hideInternalFields removes the values of non-public custom fields.
+func hideInternalFields(ps ...*person) {
+	for _, p := range ps {
+		for name := range p.Fields {
+			if d := fields.byName(name); d == nil || !d.Public {
+				delete(p.Fields, name)
+			}
+		}
+	}
+}
+
+// reindex rebuilds the search index, after the searchable fields changed.
+func reindex() {
+	if err := indexPersons(); err != nil {
+		log.Error("failed to index persons", log.Ctx{"error": err.Error()})
+	}
+}
+
+// showInternal reports whether internal information is requested, with the
+// parameter internal=true.
+func showInternal(u *url.URL) bool {
+	return u.Query().Get("internal") == "true"
+}
+
+// GET /field
+func getFieldDefs(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*fieldDef, error) {
+	return http.StatusOK, nil, fields.all(), nil
+}
+
+// POST /field
+func createFieldDef(u *url.URL, h http.Header, d *fieldDef) (int, http.Header, *fieldDef, error) {
+	d.ID = 0
+	if err := d.validate(); err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qInsertFieldDef, ql.MustMarshal(d)...); err != nil {
+		log.Error("failed insert into table FieldDef", log.Ctx{"function": "createFieldDef", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+	}
+
+	d.ID = ctx.LastInsertID
+	fields.Lock()
+	fields.list = append(fields.list, d)
+	fields.Unlock()
+
+	log.Info("field created", log.Ctx{"ID": d.ID, "Name": d.Name, "Type": d.Type})
+
+	return http.StatusCreated, http.Header{
+			"Content-Location": {fmt.Sprintf(
+				"%s://%s/api/field/%d",
+				u.Scheme,
+				u.Host,
+				d.ID,
+			)},
+		},
+		d, nil
+}
+
+// PUT /field/{id}
+func updateFieldDef(u *url.URL, h http.Header, d *fieldDef) (int, http.Header, *fieldDef, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("field ID must be an integer")
+	}
+
+	old := fields.byID(int64(id))
+	if old == nil {
+		return http.StatusNotFound, nil, nil, errors.New("field not found")
+	}
+
+	d.ID = old.ID
+	if err := d.validate(); err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qUpdateFieldDef, d.Name, d.Label, d.Type, d.OptionList, d.Required, d.Public, d.Indexed, d.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateFieldDef", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	fields.Lock()
+	for i, f := range fields.list {
+		if f.ID == d.ID {
+			fields.list[i] = d
+		}
+	}
+	fields.Unlock()
+
+	if old.Indexed || d.Indexed || old.Name != d.Name {
+		reindex()
+	}
+
+	log.Info("field updated", log.Ctx{"ID": d.ID, "Name": d.Name, "Type": d.Type})
+
+	return http.StatusOK, nil, d, nil
+}
+
+// DELETE /field/{id}
+func deleteFieldDef(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, errors.New("field ID must be an integer")
+	}
+
+	old := fields.byID(int64(id))
+	if old == nil {
+		return http.StatusNotFound, nil, nil, errors.New("field not found")
+	}
+
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qDeleteFieldDef, old.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "deleteFieldDef", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	fields.Lock()
+	for i, f := range fields.list {
+		if f.ID == old.ID {
+			fields.list = append(fields.list[:i], fields.list[i+1:]...)
+			break
+		}
+	}
+	fields.Unlock()
+
+	if old.Indexed {
+		reindex()
+	}
+
+	log.Info("field deleted", log.Ctx{"ID": old.ID, "Name": old.Name})
+
+	return http.StatusNoContent, nil, nil, nil
+}
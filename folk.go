@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -23,7 +25,51 @@ import (
 
 type images struct {
 	sync.RWMutex
-	list []string
+	list []*image
+}
+
+// all returns a copy of the list of images.
+func (i *images) all() []*image {
+	i.RLock()
+	defer i.RUnlock()
+	return append([]*image{}, i.list...)
+}
+
+// get returns the named image, or nil if there is no such image.
+func (i *images) get(filename string) *image {
+	i.RLock()
+	defer i.RUnlock()
+	for _, img := range i.list {
+		if img.Filename == filename {
+			return img
+		}
+	}
+	return nil
+}
+
+// set adds an image to the list, replacing any image with the same name.
+func (i *images) set(img *image) {
+	i.Lock()
+	defer i.Unlock()
+	for n, old := range i.list {
+		if old.Filename == img.Filename {
+			i.list[n] = img
+			return
+		}
+	}
+	i.list = append(i.list, img)
+}
+
+// remove removes the named image from the list.
+func (i *images) remove(filename string) {
+	i.Lock()
+	defer i.Unlock()
+	for n, img := range i.list {
+		if img.Filename == filename {
+			i.list = append(i.list[:n], i.list[n+1:]...)
+			return
+		}
+	}
 }
 
 // Global variables:
@@ -35,7 +81,9 @@ var (
 	imageFiles     = images{}                                    // list of uploaded images
 	imageFileNames = regexp.MustCompile(`(\.png|\.jpg|\.jpeg)$`) // allowed image formats
 	analyzer       *ftx.Analyzer                                 // indexing analyzer
+	analyzerMu     sync.RWMutex                                  // guards analyzer, and orders index updates after rebuilds
 	mtr            *appMetrics                                   // application status and metrics
+	imgStore       imageStore                                    // storage for uploaded images
 )
 
 const (
@@ -49,6 +97,17 @@ type config struct {
 	DBFile    string // path to database file
 	Username  string // basic auth username
 	Password  string // basic auth password
+
+	ImageStore  string // image storage backend: "file" or "s3"
+	ImageDir    string // directory of the "file" image store
+	S3Endpoint  string // URL of S3-compatible service, e.g. http://localhost:9000
+	S3Region    string // S3 region; defaults to us-east-1
+	S3Bucket    string // S3 bucket to store images in
+	S3Prefix    string // prefix for image object keys
+	S3AccessKey string // S3 access key ID
+	S3SecretKey string // S3 secret access key
+
+	PurgeAfterDays int // delete persons this many days after their employment ended; 0 to keep them
 }
 
 type fileHandler struct {
@@ -59,50 +118,84 @@ func (fh fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, fh.filePath)
 }
 
-// uploadHandler upload image files to the folder /data/img/
+// imageFromForm returns the image metadata given in an upload form.
+func imageFromForm(r *http.Request) (*image, error) {
+	img := &image{
+		Alt:          r.FormValue("alt"),
+		Photographer: r.FormValue("photographer"),
+		Licence:      r.FormValue("licence"),
+		Consent:      r.FormValue("consent"),
+	}
+	if !validConsent(img.Consent) {
+		return nil, errors.New("invalid consent status")
+	}
+	return img, nil
+}
+
+// storeUpload saves an uploaded image file in the image store, and records
+// its metadata. On failure it returns the HTTP status code to respond with.
+func storeUpload(fileHeader *multipart.FileHeader, img *image) (int, error) {
+	filename := fileHeader.Filename
+	if !validImageName(filename) {
+		return http.StatusBadRequest, errInvalidImageName
+	}
+	if rc, err := imgStore.Get(filename); err == nil {
+		rc.Close()
+		return http.StatusBadRequest, errors.New("an image with same name allready exists")
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		log.Error("failed to open multipart file header", log.Ctx{"error": err.Error()})
+		return http.StatusInternalServerError, err
+	}
+	defer file.Close()
+
+	err = imgStore.Put(filename, file)
+	if err != nil {
+		log.Error("failed to store image file", log.Ctx{"error": err.Error()})
+		return http.StatusInternalServerError, err
+	}
+
+	img.Filename = filename
+	img.Uploaded = time.Now()
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qInsertImage, ql.MustMarshal(img)...); err != nil {
+		log.Error("failed insert into table Image", log.Ctx{"error": err.Error()})
+		// Don't keep a file without metadata.
+		if err := imgStore.Delete(filename); err != nil {
+			log.Error("failed to delete image file", log.Ctx{"filename": filename, "error": err.Error()})
+		}
+		return http.StatusInternalServerError, errors.New("database insert failed")
+	}
+	imageFiles.set(img)
+
+	log.Info("image uploaded", log.Ctx{"filename": filename})
+	emitEvent("image.created", img)
+	return http.StatusOK, nil
+}
+
+// uploadHandler stores uploaded image files in the image store.
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseMultipartForm(MaxMemSize); err != nil {
 		log.Error("failed to parse multipart upload request", log.Ctx{"error": err.Error()})
 		http.Error(w, err.Error(), http.StatusForbidden)
+		return
 	}
 
-	var filename string
 	for _, fileHeaders := range r.MultipartForm.File {
 		for _, fileHeader := range fileHeaders {
-			file, err := fileHeader.Open()
-			defer file.Close()
+			img, err := imageFromForm(r)
 			if err != nil {
-				log.Error("failed to open multipart file header", log.Ctx{"error": err.Error()})
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			filename = fileHeader.Filename
-			path := fmt.Sprintf("data/public/img/%s", filename)
-			if _, err := os.Stat(path); err == nil {
-				http.Error(w, "an image with same name allready exists", http.StatusBadRequest)
-				return
-			}
-
-			buf, err := ioutil.ReadAll(file)
-			if err != nil {
-				log.Error("failed to read uploaded image file", log.Ctx{"error": err.Error()})
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			err = ioutil.WriteFile(path, buf, os.ModePerm)
-			if err != nil {
-				log.Error("failed to write image file", log.Ctx{"error": err.Error()})
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if status, err := storeUpload(fileHeader, img); err != nil {
+				http.Error(w, err.Error(), status)
 				return
 			}
 		}
 	}
-
-	imageFiles.Lock()
-	imageFiles.list = append(imageFiles.list, filename)
-	imageFiles.Unlock()
-
-	log.Info("image uploaded", log.Ctx{"filename": filename})
 }
 
 type appMetrics struct {
@@ -116,6 +209,41 @@ type exportMetrics struct {
 	Metrics metrics.Registry
 }
 
+// indexPersons replaces the search index with a new index of all persons.
+// Updates of the index wait for it, so none are lost.
+func indexPersons() error {
+	analyzerMu.Lock()
+	defer analyzerMu.Unlock()
+
+	t0 := time.Now()
+	a := ftx.NewNGramAnalyzer(1, 20)
+	persons, err := allPersons(readCtx)
+	if err != nil {
+		return err
+	}
+	for _, p := range persons {
+		a.Index(p.indexText(), int(p.ID))
+	}
+	analyzer = a
+
+	log.Info("Indexed DB", log.Ctx{"numPersons": len(persons), "took": time.Now().Sub(t0)})
+	return nil
+}
+
+// updateIndex replaces the text a person is indexed by, oldText, with text.
+// Either may be empty, for a person created or deleted.
+func updateIndex(id int, oldText, text string) {
+	analyzerMu.Lock()
+	defer analyzerMu.Unlock()
+
+	if oldText != "" {
+		analyzer.UnIndex(oldText, id)
+	}
+	if text != "" {
+		analyzer.Index(text, id)
+	}
+}
+
 func registerMetrics() *appMetrics {
 	var m appMetrics
 	m.StartTime = time.Now()
@@ -132,6 +260,9 @@ func main() {
 		LogFile:   "folk.log",
 		Username:  "admin",
 		Password:  "secret",
+
+		ImageStore: "file",
+		ImageDir:   "data/public/img",
 	}
 
 	// Load from config file, if it exists
@@ -176,50 +307,60 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Index DB
-	t0 := time.Now()
-	analyzer = ftx.NewNGramAnalyzer(1, 20)
-	ctx := ql.NewRWCtx()
-	rs, _, err := db.Execute(ctx, qGetAllPersons, int64(0), int64(MaxPersonsLimit))
-	if err != nil {
-		log.Error("database query failed; exiting ", log.Ctx{"error": err.Error()})
+	// Load custom field definitions
+	if err := loadFieldDefs(); err != nil {
+		log.Error("failed to load field definitions; exiting", log.Ctx{"error": err.Error()})
 		os.Exit(1)
 	}
 
-	var persons []*person
-	for _, rs := range rs {
-		if err := rs.Do(false, func(data []interface{}) (bool, error) {
-			p := &person{}
-			if err := ql.Unmarshal(p, data); err != nil {
-				return false, err
-			}
-			persons = append(persons, p)
-			return true, nil
-		}); err != nil {
-			log.Error("failed to unmarshal persons; exiting", log.Ctx{"error": err.Error()})
-			os.Exit(1)
-		}
+	// Move phone numbers and email addresses to the Contact table
+	if n, err := migrateContacts(); err != nil {
+		log.Error("failed to migrate contacts; exiting", log.Ctx{"error": err.Error()})
+		os.Exit(1)
+	} else if n > 0 {
+		log.Info("migrated contacts", log.Ctx{"numPersons": n})
 	}
 
-	for _, p := range persons {
-		analyzer.Index(fmt.Sprintf("%v %v %v", p.Name, p.Role, p.Info), int(p.ID))
+	// Make each person's department their primary membership
+	if n, err := migrateMemberships(); err != nil {
+		log.Error("failed to migrate memberships; exiting", log.Ctx{"error": err.Error()})
+		os.Exit(1)
+	} else if n > 0 {
+		log.Info("migrated memberships", log.Ctx{"numPersons": n})
 	}
 
-	log.Info("Indexed DB", log.Ctx{"numPersons": len(persons), "took": time.Now().Sub(t0)})
+	// Record when persons were created
+	if n, err := migrateCreated(); err != nil {
+		log.Error("failed to migrate creation times; exiting", log.Ctx{"error": err.Error()})
+		os.Exit(1)
+	} else if n > 0 {
+		log.Info("migrated creation times", log.Ctx{"numPersons": n})
+	}
 
-	// Load list of images
+	// Index DB
+	if err := indexPersons(); err != nil {
+		log.Error("failed to index DB; exiting", log.Ctx{"error": err.Error()})
+		os.Exit(1)
+	}
+
+	// Delete departed persons daily, if configured to
+	if cfg.PurgeAfterDays > 0 {
+		go purgeDepartedDaily(cfg.PurgeAfterDays)
+	}
 
-	files, err := ioutil.ReadDir("./data/public/img/")
+	// Load list of images
+	imgStore, err = newImageStore(cfg)
 	if err != nil {
-		log.Error("failed to read image directory", log.Ctx{"error": err.Error()})
-	} else {
-		for _, f := range files {
-			if imageFileNames.MatchString(f.Name()) {
-				imageFiles.list = append(imageFiles.list, f.Name())
-			}
-		}
+		log.Error("failed to init image store; exiting", log.Ctx{"error": err.Error()})
+		os.Exit(1)
+	}
+	if err := loadImages(); err != nil {
+		log.Error("failed to list images", log.Ctx{"error": err.Error()})
 	}
 
+	// Deliver events to webhooks
+	go deliverWebhooks()
+
 	// Request multiplexer
 
 	mux := tigertonic.NewTrieServeMux()
@@ -228,6 +369,11 @@ func main() {
 	// Static assets
 	mux.HandleNamespace("/public", http.FileServer(http.Dir("data/public/")))
 	mux.Handle("GET", "/robots.txt", fileHandler{"data/robots.txt"})
+	mux.HandleFunc("GET", "/img/{filename}", imageHandler)
+
+	// Feeds
+	mux.HandleFunc("GET", "/feeds/new.atom", newPersonsFeed)
+	mux.HandleFunc("GET", "/feeds/updated.atom", updatedPersonsFeed)
 
 	// Public pages
 	mux.Handle("GET", "/", tigertonic.Counted(
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	errImageNotFound    = errors.New("image not found")
+	errInvalidImageName = errors.New("invalid image filename")
+)
+
+// imageStore is a storage backend for uploaded image files.
+type imageStore interface {
+	// Put stores the contents of r as the image with the given name,
+	// replacing any existing image with that name.
+	Put(name string, r io.Reader) error
+
+	// Get returns the contents of the named image. The caller must close
+	// the returned reader. It returns errImageNotFound if there is no such
+	// image.
+	Get(name string) (io.ReadCloser, error)
+
+	// Delete removes the named image.
+	Delete(name string) error
+
+	// List returns all stored images.
+	List() ([]imageInfo, error)
+}
+
+// imageInfo describes a stored image file.
+type imageInfo struct {
+	Name     string
+	Size     int64
+	Modified time.Time
+}
+
+// validImageName reports whether name can be used as an image filename; it
+// must have an allowed extension and cannot contain path elements.
+func validImageName(name string) bool {
+	return imageFileNames.MatchString(name) &&
+		!strings.ContainsAny(name, `/\`) &&
+		!strings.HasPrefix(name, ".")
+}
+
+// newImageStore returns the image store selected in the configuration.
+func newImageStore(c *config) (imageStore, error) {
+	switch c.ImageStore {
+	case "", "file":
+		return fileImageStore{dir: c.ImageDir}, nil
+	case "s3":
+		return newS3ImageStore(c.S3Endpoint, c.S3Region, c.S3Bucket, c.S3Prefix, c.S3AccessKey, c.S3SecretKey)
+	default:
+		return nil, fmt.Errorf("unknown image store: %q", c.ImageStore)
+	}
+}
+
+// fileImageStore stores images as files in a local directory.
+type fileImageStore struct {
+	dir string
+}
+
+func (s fileImageStore) Put(name string, r io.Reader) error {
+	if !validImageName(name) {
+		return errInvalidImageName
+	}
+
+	// Write to a temporary file first, so that readers never see a
+	// partially written image.
+	tmp, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+func (s fileImageStore) Get(name string) (io.ReadCloser, error) {
+	if !validImageName(name) {
+		return nil, errInvalidImageName
+	}
+	f, err := os.Open(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil, errImageNotFound
+	}
+	return f, err
+}
+
+func (s fileImageStore) Delete(name string) error {
+	if !validImageName(name) {
+		return errInvalidImageName
+	}
+	err := os.Remove(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return errImageNotFound
+	}
+	return err
+}
+
+func (s fileImageStore) List() ([]imageInfo, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var res []imageInfo
+	for _, f := range files {
+		if f.IsDir() || !validImageName(f.Name()) {
+			continue
+		}
+		res = append(res, imageInfo{Name: f.Name(), Size: f.Size(), Modified: f.ModTime()})
+	}
+	return res, nil
+}
+
+// loadImages replaces the list of uploaded images with the contents of the
+// image store, together with the image metadata stored in the database.
+func loadImages() error {
+	infos, err := imgStore.List()
+	if err != nil {
+		return err
+	}
+
+	ctx := readCtx
+	rs, _, err := db.Execute(ctx, qGetAllImages)
+	if err != nil {
+		return err
+	}
+	meta := make(map[string]*image)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		img := &image{}
+		if err := ql.Unmarshal(img, data); err != nil {
+			return false, err
+		}
+		meta[img.Filename] = img
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	list := make([]*image, 0, len(infos))
+	for _, info := range infos {
+		img, ok := meta[info.Name]
+		if !ok {
+			img = &image{Filename: info.Name, Uploaded: info.Modified}
+		}
+		list = append(list, img)
+	}
+
+	imageFiles.Lock()
+	imageFiles.list = list
+	imageFiles.Unlock()
+	return nil
+}
+
+// imageHandler serves image files from the image store.
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	filename := r.URL.Query().Get("filename")
+	rc, err := imgStore.Get(filename)
+	switch err {
+	case nil:
+	case errImageNotFound, errInvalidImageName:
+		http.NotFound(w, r)
+		return
+	default:
+		log.Error("failed to read image", log.Ctx{"filename": filename, "error": err.Error()})
+		http.Error(w, "failed to read image", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(filename)))
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	if _, err := io.Copy(w, rc); err != nil {
+		log.Error("failed to write image", log.Ctx{"filename": filename, "error": err.Error()})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible service with
+// path-style addressing. It supports enough of the API for s3ImageStore.
+type fakeS3 struct {
+	sync.Mutex
+	bucket  string
+	objects map[string][]byte
+	pageLen int
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") ||
+		r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+f.bucket), "/")
+
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case r.Method == "PUT":
+		b, _ := ioutil.ReadAll(r.Body)
+		if sha256Hex(b) != r.Header.Get("X-Amz-Content-Sha256") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = b
+	case r.Method == "GET" && key == "":
+		var keys []string
+		for k := range f.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		start := 0
+		if t := r.URL.Query().Get("continuation-token"); t != "" {
+			start = sort.SearchStrings(keys, t)
+		}
+		res := s3ListResult{}
+		for i := start; i < len(keys); i++ {
+			if i-start == f.pageLen {
+				res.IsTruncated = true
+				res.NextContinuationToken = keys[i]
+				break
+			}
+			res.Contents = append(res.Contents, struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}{keys[i], int64(len(f.objects[keys[i]])), time.Now()})
+		}
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"ListBucketResult"`
+			s3ListResult
+		}{s3ListResult: res})
+	case r.Method == "GET":
+		b, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+	case r.Method == "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func testImageStore(t *testing.T, s imageStore) {
+	if err := s.Put("a.png", bytes.NewBufferString("aaa")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put("b.jpg", bytes.NewBufferString("bbb")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := s.Put("../c.jpg", bytes.NewBufferString("ccc")); err != errInvalidImageName {
+		t.Errorf("Put with path in filename: want %v, got %v", errInvalidImageName, err)
+	}
+
+	rc, err := s.Get("a.png")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "aaa" {
+		t.Errorf("Get: want \"aaa\", got %q", b)
+	}
+
+	if _, err = s.Get("x.png"); err != errImageNotFound {
+		t.Errorf("Get non-existing image: want %v, got %v", errImageNotFound, err)
+	}
+
+	infos, err := s.List()
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name)
+	}
+	sort.Strings(names)
+	if want := []string{"a.png", "b.jpg"}; !reflect.DeepEqual(want, names) {
+		t.Errorf("List: want %v, got %v", want, names)
+	}
+
+	if err = s.Delete("a.png"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err = s.Get("a.png"); err != errImageNotFound {
+		t.Errorf("Get deleted image: want %v, got %v", errImageNotFound, err)
+	}
+}
+
+func TestFileImageStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "folk-img")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testImageStore(t, fileImageStore{dir: dir})
+}
+
+func TestS3ImageStore(t *testing.T) {
+	srv := httptest.NewServer(&fakeS3{bucket: "folk", objects: make(map[string][]byte), pageLen: 1})
+	defer srv.Close()
+
+	s, err := newS3ImageStore(srv.URL, "", "folk", "img/", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testImageStore(t, s)
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// pageParams returns the offset and limit parameters. The limit defaults to
+// def; a negative limit means no limit.
+func pageParams(u *url.URL, def int) (offset, limit int, err error) {
+	if s := u.Query().Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			return 0, 0, errors.New("offset parameter must be a non-negative integer")
+		}
+	}
+	limit = def
+	if s := u.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil {
+			return 0, 0, errors.New("limit parameter must be an integer")
+		}
+	}
+	return offset, limit, nil
+}
+
+// cursor is a position in a listing: that of the item with the sort key Key.
+// Clients get it encoded, as an opaque string.
+type cursor struct {
+	Sort string `json:"s"`           // the order of the listing
+	Key  string `json:"k"`           // of the item at the position
+	Back bool   `json:"b,omitempty"` // whether the page is the one before the item, rather than after
+}
+
+// String returns the cursor encoded.
+func (c *cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// parseCursor returns the cursor encoded in s.
+func parseCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &cursor{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// idKey returns the sort key of an ID, which ends the sort keys of items so
+// they are unique.
+func idKey(id int64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+// listing is a list of items sorted by their keys, to be paged. As keys are
+// kept in cursors, a page starts right after the item it follows, whatever
+// was created or deleted since.
+type listing struct {
+	order string         // the order, as given by the sort parameter
+	keys  []string       // of the items
+	desc  bool           // whether sorted by descending key
+	swap  func(i, j int) // swaps items i and j
+}
+
+func (l *listing) Len() int { return len(l.keys) }
+func (l *listing) Less(i, j int) bool {
+	return l.before(l.keys[i], l.keys[j])
+}
+func (l *listing) Swap(i, j int) {
+	l.keys[i], l.keys[j] = l.keys[j], l.keys[i]
+	l.swap(i, j)
+}
+
+// before reports whether the item with the key a is listed before that with
+// the key b.
+func (l *listing) before(a, b string) bool {
+	if l.desc {
+		return a > b
+	}
+	return a < b
+}
+
+// page returns the range of the items on the page given by the parameters
+// cursor or offset, and limit, defaulting to def. The header X-Total-Count
+// gives the number of items, and Link the next and previous pages.
+func (l *listing) page(u *url.URL, def int) (from, to int, header http.Header, err error) {
+	offset, limit, err := pageParams(u, def)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	n := len(l.keys)
+	from = offset
+	if from > n {
+		from = n
+	}
+	to = n
+	if s := u.Query().Get("cursor"); s != "" {
+		c, err := parseCursor(s)
+		if err != nil || c.Sort != l.order {
+			return 0, 0, nil, errors.New("invalid cursor; it must be from a listing in the same order")
+		}
+		at := sort.Search(n, func(i int) bool { return !l.before(l.keys[i], c.Key) })
+		if c.Back {
+			to = at
+			from = 0
+			if limit >= 0 && to > limit {
+				from = to - limit
+			}
+		} else {
+			from = at
+			if from < n && l.keys[from] == c.Key {
+				from++
+			}
+		}
+	}
+	if limit >= 0 && from+limit < to {
+		to = from + limit
+	}
+
+	header = http.Header{"X-Total-Count": {strconv.Itoa(n)}}
+	link := func(c *cursor, rel string) {
+		q := u.Query()
+		q.Del("offset")
+		q.Set("cursor", c.String())
+		// Routed in the /api namespace, the path may have it stripped.
+		header.Add("Link", fmt.Sprintf(`<%s://%s/api%s?%s>; rel="%s"`,
+			u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/api"), q.Encode(), rel))
+	}
+	if from < to && to < n {
+		link(&cursor{Sort: l.order, Key: l.keys[to-1]}, "next")
+	}
+	if from < to && from > 0 {
+		link(&cursor{Sort: l.order, Key: l.keys[from], Back: true}, "prev")
+	}
+	return from, to, header, nil
+}
+
+// personKeys are the sort keys of persons in the orders they can be sorted
+// in, by the sort parameter, besides by department and sort name.
+var personKeys = map[string]func(p *person) string{
+	"id": func(p *person) string { return idKey(p.ID) },
+	"name": func(p *person) string {
+		return collationKey(p.Name) + "\x00" + idKey(p.ID)
+	},
+	"updated": func(p *person) string {
+		return p.Updated.UTC().Format("2006-01-02T15:04:05.000000000") + "\x00" + idKey(p.ID)
+	},
+}
+
+// sortPersons sorts the persons as given by the sort parameter, or by def if
+// there is none; prefixed with "-", the order is reversed. Names are sorted
+// in Norwegian order. Sorted by department, persons are sorted by the name of
+// their primary department, and then by name; by sortName, by their sort
+// name, which has the family name first. On failure it returns the HTTP
+// status code to respond with.
+func sortPersons(ctx *ql.TCtx, u *url.URL, ps []*person, def, function string) (*listing, int, error) {
+	by := u.Query().Get("sort")
+	if by == "" {
+		by = def
+	}
+	key, ok := personKeys[strings.TrimPrefix(by, "-")]
+	switch strings.TrimPrefix(by, "-") {
+	case "dept":
+		names, err := departmentNames(ctx)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+			return nil, http.StatusInternalServerError, errors.New("database query failed")
+		}
+		byName := personKeys["name"]
+		key, ok = func(p *person) string {
+			return collationKey(names[p.Dept]) + "\x00" + byName(p)
+		}, true
+	case "sortName":
+		names, err := personSortNames(ctx)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+			return nil, http.StatusInternalServerError, errors.New("database query failed")
+		}
+		key, ok = func(p *person) string {
+			name, stored := names[p.ID]
+			if !stored {
+				name = defaultSortName(p.Name)
+			}
+			return collationKey(name) + "\x00" + idKey(p.ID)
+		}, true
+	}
+	if !ok {
+		return nil, http.StatusBadRequest, errors.New("unknown sort order " + strconv.Quote(by))
+	}
+
+	l := &listing{
+		order: by,
+		keys:  make([]string, len(ps)),
+		desc:  strings.HasPrefix(by, "-"),
+		swap:  func(i, j int) { ps[i], ps[j] = ps[j], ps[i] },
+	}
+	for i, p := range ps {
+		l.keys[i] = key(p)
+	}
+	sort.Sort(l)
+	return l, http.StatusOK, nil
+}
+
+// personFilter is what persons listed must match, as given by parameters.
+type personFilter struct {
+	only         map[int64]bool // if not nil, only these persons
+	not          map[int64]bool // not these persons
+	hasImage     string         // "true" or "false" if given
+	updatedSince time.Time      // if not zero, only persons updated since
+}
+
+// empty reports whether the filter lets every person through.
+func (f *personFilter) empty() bool {
+	return f.only == nil && len(f.not) == 0 && f.hasImage == "" && f.updatedSince.IsZero()
+}
+
+// matches reports whether the person is let through the filter.
+func (f *personFilter) matches(p *person) bool {
+	switch {
+	case f.only != nil && !f.only[p.ID], f.not[p.ID]:
+		return false
+	case f.hasImage == "true" && p.Img == "", f.hasImage == "false" && p.Img != "":
+		return false
+	case !f.updatedSince.IsZero() && p.Updated.Before(f.updatedSince):
+		return false
+	}
+	return true
+}
+
+// restrict restricts the filter to the persons ids.
+func (f *personFilter) restrict(ids map[int64]bool) {
+	if f.only == nil {
+		f.only = ids
+		return
+	}
+	for id := range f.only {
+		if !ids[id] {
+			delete(f.only, id)
+		}
+	}
+}
+
+// filterParams returns the filter given by the parameters dept (members of
+// the department or its subdepartments), role, hasImage and updatedSince
+// (a date, or an RFC 3339 time), besides those of location and inactive. On
+// failure it returns the HTTP status code to respond with.
+func filterParams(ctx *ql.TCtx, u *url.URL, function string) (*personFilter, int, error) {
+	q := u.Query()
+	f := &personFilter{}
+	var err error
+	if s := q.Get("hasImage"); s != "" {
+		if s != "true" && s != "false" {
+			return nil, http.StatusBadRequest, errors.New("hasImage parameter must be true or false")
+		}
+		f.hasImage = s
+	}
+	if s := q.Get("updatedSince"); s != "" {
+		if f.updatedSince, err = time.Parse(time.RFC3339, s); err != nil {
+			if f.updatedSince, err = time.ParseInLocation(dateLayout, s, time.Local); err != nil {
+				return nil, http.StatusBadRequest, errors.New("updatedSince parameter must be a date or an RFC 3339 time")
+			}
+		}
+	}
+	var dept int
+	if s := q.Get("dept"); s != "" {
+		if dept, err = strconv.Atoi(s); err != nil {
+			return nil, http.StatusBadRequest, errors.New("dept parameter must be an integer")
+		}
+	}
+
+	located, err := locatedPersons(ctx, u)
+	if err == nil && located != nil {
+		f.restrict(located)
+	}
+	var members map[int64]bool
+	if err == nil && dept != 0 {
+		if members, err = deptMembers(ctx, int64(dept)); err == nil {
+			f.restrict(members)
+		}
+	}
+	if role := strings.TrimSpace(q.Get("role")); err == nil && role != "" {
+		if members, err = roleMembers(ctx, role); err == nil {
+			f.restrict(members)
+		}
+	}
+	if err == nil {
+		f.not, err = inactivePersons(ctx, u)
+	}
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	return f, http.StatusOK, nil
+}
+
+// projectPersons returns the persons with only the fields given by the
+// fields parameter, comma separated, and ID.
+func projectPersons(ps []*person, fields string) ([]map[string]json.RawMessage, error) {
+	t := reflect.TypeOf(person{})
+	keep := map[string]bool{"ID": true}
+	for _, name := range strings.Split(fields, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		f, ok := t.FieldByNameFunc(func(s string) bool { return strings.EqualFold(s, name) })
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		keep[f.Name] = true
+	}
+
+	res := make([]map[string]json.RawMessage, 0, len(ps))
+	for _, p := range ps {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		var all map[string]json.RawMessage
+		if err := json.Unmarshal(b, &all); err != nil {
+			return nil, err
+		}
+		m := make(map[string]json.RawMessage, len(keep))
+		for k := range keep {
+			m[k] = all[k]
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// GET /person
+func getPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+	status, header, persons, err := getAllPersons(u, h, nil)
+	fields := u.Query().Get("fields")
+	if err != nil || fields == "" {
+		return status, header, persons, err
+	}
+	res, err := projectPersons(persons, fields)
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	return status, header, res, nil
+}
+
+// GET /department/{id}/persons
+func getDepartmentPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*person, error) {
+	id, err := deptIDParam(u, "id")
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	ctx := readCtx
+	d, err := fetchDepartment(ctx, id)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getDepartmentPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if d == nil {
+		return http.StatusNotFound, nil, nil, errors.New("department does not exist")
+	}
+
+	members := make(map[int64]bool)
+	if u.Query().Get("recursive") == "true" {
+		members, err = deptMembers(ctx, id)
+	} else {
+		var ids []int64
+		ids, err = idRows(ctx, qDeptHasPersons, id)
+		for _, id := range ids {
+			members[id] = true
+		}
+	}
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getDepartmentPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	inactive, err := inactivePersons(ctx, u)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getDepartmentPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	for id := range inactive {
+		delete(members, id)
+	}
+
+	persons, err := personsByIDs(ctx, members)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getDepartmentPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	l, status, err := sortPersons(ctx, u, persons, "name", "getDepartmentPersons")
+	if err != nil {
+		return status, nil, nil, err
+	}
+	from, to, header, err := l.page(u, MaxPersonsLimit)
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	persons = persons[from:to]
+	if !showInternal(u) {
+		hideInternal(persons...)
+	}
+
+	return http.StatusOK, header, persons, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/cznic/ql"
+)
+
+var (
+	qGetLocation     = ql.MustCompile(`SELECT Person, Branch, Building, Floor, Room FROM Location WHERE Person == $1;`)
+	qGetAllLocations = ql.MustCompile(`SELECT Person, Branch, Building, Floor, Room FROM Location;`)
+	qInsertLocation  = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Location VALUES($1, $2, $3, $4, $5); COMMIT;`)
+	qDeleteLocation  = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Location WHERE Person == $1; COMMIT;`)
+)
+
+// location is where a person physically works, which need not be where the
+// person's department is.
+type location struct {
+	Person   int64 `json:"-"`
+	Branch   string
+	Building string
+	Floor    string // e.g. "3" or "U1"
+	Room     string // room or desk
+}
+
+// empty reports whether no part of the location is given.
+func (l *location) empty() bool {
+	return l.Branch == "" && l.Building == "" && l.Floor == "" && l.Room == ""
+}
+
+// matches reports whether the location has the parts given in f; parts
+// missing from f match anything. Case is ignored.
+func (l *location) matches(f *location) bool {
+	match := func(v, want string) bool {
+		return want == "" || strings.EqualFold(v, want)
+	}
+	return match(l.Branch, f.Branch) && match(l.Building, f.Building) &&
+		match(l.Floor, f.Floor) && match(l.Room, f.Room)
+}
+
+// locationFilter returns the location given by the parameters branch,
+// building, floor and room, or nil if none of them are given.
+func locationFilter(u *url.URL) *location {
+	q := u.Query()
+	f := &location{
+		Branch:   strings.TrimSpace(q.Get("branch")),
+		Building: strings.TrimSpace(q.Get("building")),
+		Floor:    strings.TrimSpace(q.Get("floor")),
+		Room:     strings.TrimSpace(q.Get("room")),
+	}
+	if f.empty() {
+		return nil
+	}
+	return f
+}
+
+// prepareLocation tidies the location of a person being created or updated.
+// If Location is missing, the location of old is kept.
+func prepareLocation(p, old *person) {
+	if p.Location == nil {
+		p.Location = old.Location
+	}
+	if p.Location == nil {
+		p.Location = &location{}
+	}
+	l := p.Location
+	l.Branch = strings.TrimSpace(l.Branch)
+	l.Building = strings.TrimSpace(l.Building)
+	l.Floor = strings.TrimSpace(l.Floor)
+	l.Room = strings.TrimSpace(l.Room)
+}
+
+// savePersonLocation replaces the location of a person.
+func savePersonLocation(ctx *ql.TCtx, id int64, l *location) (err error) {
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeleteLocation, id); err != nil {
+		return err
+	}
+	if l != nil && !l.empty() {
+		l.Person = id
+		if _, _, err = db.Execute(ctx, qInsertLocation, ql.MustMarshal(l)...); err != nil {
+			return err
+		}
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// personLocations returns the locations of the given person, or of all
+// persons, by person ID.
+func personLocations(ctx *ql.TCtx, ps ...*person) (map[int64]*location, error) {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetLocation, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllLocations)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[int64]*location)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		l := &location{}
+		if err := ql.Unmarshal(l, data); err != nil {
+			return false, err
+		}
+		res[l.Person] = l
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setPersonLocations fills in the locations of the given persons.
+func setPersonLocations(ctx *ql.TCtx, ps ...*person) error {
+	ls, err := personLocations(ctx, ps...)
+	if err != nil {
+		return err
+	}
+	for _, p := range ps {
+		p.Location = ls[p.ID]
+		if p.Location == nil {
+			p.Location = &location{}
+		}
+	}
+	return nil
+}
+
+// locatedPersons returns the IDs of the persons at the location given by the
+// request parameters, or nil if the request doesn't filter by location.
+func locatedPersons(ctx *ql.TCtx, u *url.URL) (map[int64]bool, error) {
+	f := locationFilter(u)
+	if f == nil {
+		return nil, nil
+	}
+	ls, err := personLocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]bool)
+	for id, l := range ls {
+		if l.matches(f) {
+			res[id] = true
+		}
+	}
+	return res, nil
+}
+
+// locationIndexText returns the branch and building of a person, to be
+// searchable.
+func locationIndexText(p *person) string {
+	if p.Location == nil {
+		return ""
+	}
+	return strings.TrimSpace(p.Location.Branch + " " + p.Location.Building)
+}
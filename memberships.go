@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetMemberships        = ql.MustCompile(`SELECT Person, Dept, Role, Primary, Percent FROM Membership WHERE Person == $1;`)
+	qGetAllMemberships     = ql.MustCompile(`SELECT Person, Dept, Role, Primary, Percent FROM Membership;`)
+	qInsertMembership      = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Membership VALUES($1, $2, $3, $4, $5); COMMIT;`)
+	qDeleteMemberships     = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Membership WHERE Person == $1; COMMIT;`)
+	qSetPersonDept         = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Person SET Dept = $1, Role = $2 WHERE id() == $3; COMMIT;`)
+	qPersonDepts           = ql.MustCompile(`SELECT id(), Dept, Role FROM Person;`)
+	qPersonsWithMembership = ql.MustCompile(`SELECT DISTINCT Person FROM Membership;`)
+)
+
+// membership is a person's membership of a department.
+type membership struct {
+	Person  int64 `json:"-"`
+	Dept    int64
+	Role    string // the person's role in the department
+	Primary bool   // the primary department is also the person's Dept
+	Percent int64  // share of the person's position, 1-100; 0 if not given
+}
+
+// primaryMembership returns the primary membership, or nil if there are no
+// memberships.
+func primaryMembership(ms []*membership) *membership {
+	for _, m := range ms {
+		if m.Primary {
+			return m
+		}
+	}
+	if len(ms) > 0 {
+		return ms[0]
+	}
+	return nil
+}
+
+// mergeMembership returns the memberships after a client which only knows
+// the single Dept and Role set them: the primary membership is replaced.
+func mergeMembership(ms []*membership, dept int64, role string) []*membership {
+	if dept == 0 {
+		return ms
+	}
+	if pm := primaryMembership(ms); pm != nil && pm.Dept == dept && pm.Role == role {
+		return ms
+	}
+	res := []*membership{{Dept: dept, Role: role, Primary: true}}
+	for _, m := range ms {
+		if !m.Primary && m.Dept != dept {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// deptExists reports whether there is a department with the given ID.
+func deptExists(ctx *ql.TCtx, id int64) (bool, error) {
+	rs, _, err := db.Execute(ctx, qGetDept, id)
+	if err != nil {
+		return false, err
+	}
+	row, err := rs[0].FirstRow()
+	return row != nil, err
+}
+
+// inSubtree reports whether the department id is root or one of its
+// subdepartments, walking up the parents of id. A cycle of parents ends the
+// walk.
+func inSubtree(ctx *ql.TCtx, id, root int64) (bool, error) {
+	seen := make(map[int64]bool)
+	for id != 0 && !seen[id] {
+		if id == root {
+			return true, nil
+		}
+		seen[id] = true
+		rs, _, err := db.Execute(ctx, qGetDept, id)
+		if err != nil {
+			return false, err
+		}
+		row, err := rs[0].FirstRow()
+		if err != nil || row == nil {
+			return false, err
+		}
+		d := department{}
+		if err := ql.Unmarshal(&d, row); err != nil {
+			return false, err
+		}
+		id = d.Parent
+	}
+	return false, nil
+}
+
+// prepareMemberships validates the memberships of a person being created or
+// updated, and sets Dept and Role to the primary ones. If Memberships is
+// missing, the memberships of old are kept, with any change of Dept or Role
+// applied. On failure it returns the HTTP status code to respond with.
+func prepareMemberships(ctx *ql.TCtx, p, old *person, function string) (int, error) {
+	if p.Memberships == nil {
+		p.Memberships = mergeMembership(old.Memberships, p.Dept, p.Role)
+	}
+	if len(p.Memberships) == 0 {
+		return http.StatusBadRequest, errors.New("person must belong to a department")
+	}
+
+	primary := 0
+	seen := make(map[int64]bool)
+	for _, m := range p.Memberships {
+		if seen[m.Dept] {
+			return http.StatusBadRequest, errors.New("person can only belong to a department once")
+		}
+		seen[m.Dept] = true
+		if m.Percent < 0 || m.Percent > 100 {
+			return http.StatusBadRequest, errors.New("percent must be between 1 and 100, or 0 if not given")
+		}
+		if m.Primary {
+			primary++
+		}
+
+		ok, err := deptExists(ctx, m.Dept)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if !ok {
+			return http.StatusNotFound, errors.New("department does not exist")
+		}
+	}
+	if primary > 1 {
+		return http.StatusBadRequest, errors.New("only one department can be primary")
+	}
+	if primary == 0 {
+		p.Memberships[0].Primary = true
+	}
+
+	pm := primaryMembership(p.Memberships)
+	p.Dept, p.Role = pm.Dept, pm.Role
+	return http.StatusOK, nil
+}
+
+// savePersonMemberships replaces the memberships of a person, and sets the
+// person's Dept and Role to the primary ones.
+func savePersonMemberships(ctx *ql.TCtx, id int64, ms []*membership) (err error) {
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeleteMemberships, id); err != nil {
+		return err
+	}
+	for _, m := range ms {
+		m.Person = id
+		if _, _, err = db.Execute(ctx, qInsertMembership, ql.MustMarshal(m)...); err != nil {
+			return err
+		}
+	}
+	if pm := primaryMembership(ms); pm != nil {
+		if _, _, err = db.Execute(ctx, qSetPersonDept, pm.Dept, pm.Role, id); err != nil {
+			return err
+		}
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// setPersonMemberships fills in the memberships of the given persons, with
+// the primary membership first.
+func setPersonMemberships(ctx *ql.TCtx, ps ...*person) error {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetMemberships, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllMemberships)
+	}
+	if err != nil {
+		return err
+	}
+
+	byPerson := make(map[int64][]*membership)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		m := &membership{}
+		if err := ql.Unmarshal(m, data); err != nil {
+			return false, err
+		}
+		if m.Primary {
+			byPerson[m.Person] = append([]*membership{m}, byPerson[m.Person]...)
+		} else {
+			byPerson[m.Person] = append(byPerson[m.Person], m)
+		}
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		p.Memberships = byPerson[p.ID]
+		if p.Memberships == nil {
+			p.Memberships = []*membership{}
+		}
+	}
+	return nil
+}
+
+// membershipsIndexText returns the roles of a person in departments other
+// than the primary one, to be searchable.
+func membershipsIndexText(p *person) string {
+	var text string
+	for _, m := range p.Memberships {
+		if !m.Primary && m.Role != "" {
+			text += " " + m.Role
+		}
+	}
+	return text
+}
+
+// deptMembers returns the IDs of the persons who are members of the
+// department or any of its subdepartments.
+func deptMembers(ctx *ql.TCtx, dept int64) (map[int64]bool, error) {
+	members := make(map[int64]bool)
+	seen := map[int64]bool{dept: true}
+	depts := []int64{dept}
+	for len(depts) > 0 {
+		d := depts[0]
+		depts = depts[1:]
+
+		rs, _, err := db.Execute(ctx, qDeptHasPersons, d)
+		if err != nil {
+			return nil, err
+		}
+		if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+			members[data[0].(int64)] = true
+			return true, nil
+		}); err != nil {
+			return nil, err
+		}
+
+		rs, _, err = db.Execute(ctx, qDeptHasDept, d)
+		if err != nil {
+			return nil, err
+		}
+		if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+			// A cycle of parents must not make the walk go on forever.
+			if sub := data[0].(int64); !seen[sub] {
+				seen[sub] = true
+				depts = append(depts, sub)
+			}
+			return true, nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return members, nil
+}
+
+// roleMembers returns the IDs of the persons with the role in any
+// department, regardless of case.
+func roleMembers(ctx *ql.TCtx, role string) (map[int64]bool, error) {
+	rs, _, err := db.Execute(ctx, qGetAllMemberships)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[int64]bool)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		m := &membership{}
+		if err := ql.Unmarshal(m, data); err != nil {
+			return false, err
+		}
+		if strings.EqualFold(strings.TrimSpace(m.Role), role) {
+			members[m.Person] = true
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// migrateMemberships gives persons without memberships a primary membership
+// of their Dept, with their Role.
+func migrateMemberships() (int, error) {
+	ctx := ql.NewRWCtx()
+	rs, _, err := db.Execute(ctx, qPersonsWithMembership)
+	if err != nil {
+		return 0, err
+	}
+	migrated := make(map[int64]bool)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		migrated[data[0].(int64)] = true
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	rs, _, err = db.Execute(ctx, qPersonDepts)
+	if err != nil {
+		return 0, err
+	}
+	var ms []*membership
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		m := &membership{Person: data[0].(int64), Dept: data[1].(int64), Role: data[2].(string), Primary: true}
+		if !migrated[m.Person] && m.Dept != 0 {
+			ms = append(ms, m)
+		}
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+
+	for _, m := range ms {
+		if err := savePersonMemberships(ctx, m.Person, []*membership{m}); err != nil {
+			return 0, err
+		}
+	}
+	return len(ms), nil
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// MaxPatchSize is the maximum size of a PATCH request body.
+const MaxPatchSize = 1024 * 1024
+
+const (
+	mergePatchType = "application/merge-patch+json" // RFC 7396
+	jsonPatchType  = "application/json-patch+json"  // RFC 6902
+)
+
+// patchOp is an operation of a JSON Patch.
+type patchOp struct {
+	Op    string
+	Path  string
+	From  string
+	Value json.RawMessage
+
+	path, from []string
+	value      interface{}
+}
+
+// errPatchConflict is returned when a JSON Patch cannot be applied to the
+// document, such as when a test fails or a location doesn't exist.
+type errPatchConflict struct{ msg string }
+
+func (e errPatchConflict) Error() string { return e.msg }
+
+func patchConflict(format string, args ...interface{}) error {
+	return errPatchConflict{fmt.Sprintf(format, args...)}
+}
+
+// decodeJSON decodes JSON, keeping numbers as they are.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// parsePointer returns the reference tokens of a JSON Pointer (RFC 6901).
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return []string{}, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("JSON Pointer must start with /, got %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// decodeJSONPatch decodes and checks the operations of a JSON Patch.
+func decodeJSONPatch(b []byte) ([]*patchOp, error) {
+	var ops []*patchOp
+	if err := json.Unmarshal(b, &ops); err != nil {
+		return nil, errors.New("JSON Patch must be an array of operations: " + err.Error())
+	}
+	for _, op := range ops {
+		var err error
+		if op.path, err = parsePointer(op.Path); err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, fmt.Errorf("%s operation must have a value", op.Op)
+			}
+			if op.value, err = decodeJSON(op.Value); err != nil {
+				return nil, err
+			}
+		case "move", "copy":
+			if op.from, err = parsePointer(op.From); err != nil {
+				return nil, err
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("unknown JSON Patch operation %q", op.Op)
+		}
+	}
+	return ops, nil
+}
+
+// arrayIndex returns the array index given by a reference token. With end,
+// "-" and the length of the array are allowed, for adding to it.
+func arrayIndex(token string, length int, end bool) (int, error) {
+	if end && token == "-" {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, patchConflict("invalid array index %q", token)
+	}
+	if i > length || (i == length && !end) {
+		return 0, patchConflict("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+// jsonGet returns the value at path in doc.
+func jsonGet(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			v, ok := node[token]
+			if !ok {
+				return nil, patchConflict("member %q not found", token)
+			}
+			doc = v
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, patchConflict("cannot get %q of a value which is not an object or array", token)
+		}
+	}
+	return doc, nil
+}
+
+// jsonUpdate returns doc with the container holding the last token of path
+// replaced by f of it.
+func jsonUpdate(doc interface{}, path []string, f func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, patchConflict("member %q not found", path[0])
+		}
+		v, err := jsonUpdate(child, path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		node[path[0]] = v
+		return node, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(node), false)
+		if err != nil {
+			return nil, err
+		}
+		v, err := jsonUpdate(node[i], path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = v
+		return node, nil
+	}
+	return nil, patchConflict("cannot get %q of a value which is not an object or array", path[0])
+}
+
+// jsonAdd returns doc with value added at path.
+func jsonAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonUpdate(doc, path, func(c interface{}, token string) (interface{}, error) {
+		switch node := c.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, patchConflict("cannot add %q to a value which is not an object or array", token)
+	})
+}
+
+// jsonRemove returns doc with the value at path removed.
+func jsonRemove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, patchConflict("cannot remove the whole document")
+	}
+	return jsonUpdate(doc, path, func(c interface{}, token string) (interface{}, error) {
+		switch node := c.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, patchConflict("member %q not found", token)
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, patchConflict("cannot remove %q from a value which is not an object or array", token)
+	})
+}
+
+// jsonReplace returns doc with the value at path replaced by value.
+func jsonReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonUpdate(doc, path, func(c interface{}, token string) (interface{}, error) {
+		switch node := c.(type) {
+		case map[string]interface{}:
+			if _, ok := node[token]; !ok {
+				return nil, patchConflict("member %q not found", token)
+			}
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			node[i] = value
+			return node, nil
+		}
+		return nil, patchConflict("cannot replace %q in a value which is not an object or array", token)
+	})
+}
+
+// jsonEqual reports whether two decoded JSON values are equal, comparing
+// numbers by value.
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, err1 := a.Float64()
+		y, err2 := b.Float64()
+		return err1 == nil && err2 == nil && x == y
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// jsonCopy returns a deep copy of a decoded JSON value.
+func jsonCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, w := range v {
+			c[k] = jsonCopy(w)
+		}
+		return c
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, w := range v {
+			c[i] = jsonCopy(w)
+		}
+		return c
+	}
+	return v
+}
+
+// applyJSONPatch applies the operations of a JSON Patch to doc, in order.
+func applyJSONPatch(doc interface{}, ops []*patchOp) (interface{}, error) {
+	var err error
+	for _, op := range ops {
+		switch op.Op {
+		case "add":
+			doc, err = jsonAdd(doc, op.path, jsonCopy(op.value))
+		case "remove":
+			doc, err = jsonRemove(doc, op.path)
+		case "replace":
+			doc, err = jsonReplace(doc, op.path, jsonCopy(op.value))
+		case "move":
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				return nil, patchConflict("cannot move %q into itself", op.From)
+			}
+			var v interface{}
+			if v, err = jsonGet(doc, op.from); err == nil {
+				if doc, err = jsonRemove(doc, op.from); err == nil {
+					doc, err = jsonAdd(doc, op.path, v)
+				}
+			}
+		case "copy":
+			var v interface{}
+			if v, err = jsonGet(doc, op.from); err == nil {
+				doc, err = jsonAdd(doc, op.path, jsonCopy(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = jsonGet(doc, op.path); err == nil && !jsonEqual(v, op.value) {
+				err = patchConflict("test of %q failed", op.Path)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// applyMergePatch applies a JSON Merge Patch to target.
+func applyMergePatch(target, patch interface{}) interface{} {
+	pm, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]interface{})
+	if !ok {
+		tm = make(map[string]interface{})
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = applyMergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
+
+// patchDocument applies the patch in the request body to the JSON of cur,
+// according to its content type, and returns the document before and after.
+// On failure it returns the HTTP status code to respond with.
+func patchDocument(r *http.Request, cur interface{}) (before, after map[string]interface{}, status int, err error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType && mediaType != jsonPatchType && mediaType != "application/json" {
+		return nil, nil, http.StatusUnsupportedMediaType,
+			fmt.Errorf("patch must be given as %s or %s", mergePatchType, jsonPatchType)
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, MaxPatchSize))
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	b, err := json.Marshal(cur)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	orig, err := decodeJSON(b)
+	if err != nil {
+		return nil, nil, http.StatusInternalServerError, err
+	}
+	doc := jsonCopy(orig)
+
+	if mediaType == jsonPatchType {
+		ops, err := decodeJSONPatch(body)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, err
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			if _, ok := err.(errPatchConflict); ok {
+				return nil, nil, http.StatusConflict, err
+			}
+			return nil, nil, http.StatusBadRequest, err
+		}
+	} else {
+		patch, err := decodeJSON(body)
+		if err != nil {
+			return nil, nil, http.StatusBadRequest, errors.New("merge patch must be JSON: " + err.Error())
+		}
+		doc = applyMergePatch(doc, patch)
+	}
+
+	after, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, nil, http.StatusUnprocessableEntity, errors.New("patched document must be an object")
+	}
+	return orig.(map[string]interface{}), after, http.StatusOK, nil
+}
+
+// unmarshalPatched decodes the patched document into v, refusing members v
+// doesn't have.
+func unmarshalPatched(doc map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.New("invalid patched document: " + err.Error())
+	}
+	return nil
+}
+
+// writePatchResult writes the response of a PATCH handled by a marshaled
+// handler.
+func writePatchResult(w http.ResponseWriter, status int, h http.Header, v interface{}, err error) {
+	for k, vs := range h {
+		w.Header()[k] = vs
+	}
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	writeJSON(w, status, v)
+}
+
+// patchError writes the error of a failed patch.
+func patchError(w http.ResponseWriter, status int, err error) {
+	if status == http.StatusUnsupportedMediaType {
+		w.Header().Set("Accept-Patch", mergePatchType+", "+jsonPatchType)
+	}
+	writeError(w, status, err)
+}
+
+// Members of a person which are given both by themselves and by a list; if a
+// patch only changes the former, the list is left to be updated from it.
+var personSummaries = map[string][]string{
+	"Phones":      {"Phone"},
+	"Emails":      {"Email"},
+	"Memberships": {"Dept", "Role"},
+}
+
+// PATCH /person/{id}
+func patchPerson(w http.ResponseWriter, r *http.Request) {
+	u := *r.URL
+	q := u.Query()
+	q.Set("internal", "true")
+	u.RawQuery = q.Encode()
+
+	status, h, cur, err := getPerson(&u, r.Header, nil)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	tag := h.Get("ETag")
+	if !ifMatch(r.Header, tag) {
+		writeError(w, http.StatusPreconditionFailed, errPreconditionFailed)
+		return
+	}
+
+	before, after, status, err := patchDocument(r, cur)
+	if err != nil {
+		patchError(w, status, err)
+		return
+	}
+	for list, summary := range personSummaries {
+		changed := false
+		for _, s := range summary {
+			changed = changed || !jsonEqual(before[s], after[s])
+		}
+		if changed && jsonEqual(before[list], after[list]) {
+			delete(after, list)
+		}
+	}
+
+	p := &person{}
+	if err := unmarshalPatched(after, p); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// Update the version patched, not any later one.
+	uh := http.Header{}
+	for k, vs := range r.Header {
+		uh[k] = vs
+	}
+	uh.Set("If-Match", tag)
+	status, h, res, err := updatePerson(r.URL, uh, p)
+	writePatchResult(w, status, h, res, err)
+}
+
+// PATCH /department/{id}
+func patchDepartment(w http.ResponseWriter, r *http.Request) {
+	status, h, cur, err := getDepartment(r.URL, r.Header, nil)
+	if err != nil {
+		writeError(w, status, err)
+		return
+	}
+	tag := h.Get("ETag")
+	if !ifMatch(r.Header, tag) {
+		writeError(w, http.StatusPreconditionFailed, errPreconditionFailed)
+		return
+	}
+
+	_, after, status, err := patchDocument(r, cur)
+	if err != nil {
+		patchError(w, status, err)
+		return
+	}
+
+	dept := &department{}
+	if err := unmarshalPatched(after, dept); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	uh := http.Header{}
+	for k, vs := range r.Header {
+		uh[k] = vs
+	}
+	uh.Set("If-Match", tag)
+	status, h, res, err := updateDepartment(r.URL, uh, dept)
+	writePatchResult(w, status, h, res, err)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetPersonImages    = ql.MustCompile(`SELECT Person, Filename, Label, Position, Primary FROM PersonImage WHERE Person == $1 ORDER BY Position ASC;`)
+	qGetAllPersonImages = ql.MustCompile(`SELECT Person, Filename, Label, Position, Primary FROM PersonImage ORDER BY Person, Position ASC;`)
+	qInsertPersonImage  = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO PersonImage VALUES($1, $2, $3, $4, $5); COMMIT;`)
+	qDeletePersonImages = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM PersonImage WHERE Person == $1; COMMIT;`)
+	qImageInSet         = ql.MustCompile(`SELECT DISTINCT Person FROM PersonImage WHERE Filename == $1;`)
+	qBegin              = ql.MustCompile(`BEGIN TRANSACTION;`)
+	qCommit             = ql.MustCompile(`COMMIT;`)
+	qRollback           = ql.MustCompile(`ROLLBACK;`)
+)
+
+// personImage is one of the images of a person.
+type personImage struct {
+	Person   int64 `json:"-"`
+	Filename string
+	Label    string // e.g. "formal" or "casual"
+	Position int64  // position in the ordered set of images, starting at 0
+	Primary  bool   // the primary image is also the person's Img
+}
+
+// imageOrder is the request body for reordering the images of a person.
+type imageOrder struct {
+	Order   []string // filenames in the new order
+	Primary string   // optionally, the filename of the new primary image
+}
+
+// personImages returns the ordered images of a person. Persons who got their
+// image before persons could have several images have no rows in
+// PersonImage; their Img is returned as the only, primary, image.
+func personImages(ctx *ql.TCtx, p *person) ([]*personImage, error) {
+	rs, _, err := db.Execute(ctx, qGetPersonImages, p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := []*personImage{}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		pi := &personImage{}
+		if err := ql.Unmarshal(pi, data); err != nil {
+			return false, err
+		}
+		imgs = append(imgs, pi)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	if len(imgs) == 0 && p.Img != "" {
+		imgs = append(imgs, &personImage{Person: p.ID, Filename: p.Img, Primary: true})
+	}
+	return imgs, nil
+}
+
+// setPersonImages fills in the images of the given persons.
+func setPersonImages(ctx *ql.TCtx, ps ...*person) error {
+	if len(ps) == 1 {
+		imgs, err := personImages(ctx, ps[0])
+		ps[0].Images = imgs
+		return err
+	}
+
+	rs, _, err := db.Execute(ctx, qGetAllPersonImages)
+	if err != nil {
+		return err
+	}
+
+	byPerson := make(map[int64][]*personImage)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		pi := &personImage{}
+		if err := ql.Unmarshal(pi, data); err != nil {
+			return false, err
+		}
+		byPerson[pi.Person] = append(byPerson[pi.Person], pi)
+		return true, nil
+	}); err != nil {
+		return err
+	}
+
+	for _, p := range ps {
+		p.Images = byPerson[p.ID]
+		if len(p.Images) == 0 {
+			p.Images = []*personImage{}
+			if p.Img != "" {
+				p.Images = append(p.Images, &personImage{Person: p.ID, Filename: p.Img, Primary: true})
+			}
+		}
+	}
+	return nil
+}
+
+// savePersonImages replaces the images of a person with imgs, in the given
+// order. If none of the images is marked as primary, the first one is. The
+// person's Img is set to the primary image. It returns the filename of the
+// primary image.
+func savePersonImages(ctx *ql.TCtx, id int64, imgs []*personImage) (primary string, err error) {
+	for _, pi := range imgs {
+		if pi.Primary && primary == "" {
+			primary = pi.Filename
+		}
+	}
+	if primary == "" && len(imgs) > 0 {
+		primary = imgs[0].Filename
+	}
+
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeletePersonImages, id); err != nil {
+		return "", err
+	}
+	for i, pi := range imgs {
+		pi.Person = id
+		pi.Position = int64(i)
+		pi.Primary = pi.Filename == primary
+		if _, _, err = db.Execute(ctx, qInsertPersonImage, ql.MustMarshal(pi)...); err != nil {
+			return "", err
+		}
+	}
+	if _, _, err = db.Execute(ctx, qSetPersonImg, primary, id); err != nil {
+		return "", err
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return primary, err
+}
+
+// personIDParam returns the person ID from the id parameter of a request.
+func personIDParam(u *url.URL) (int64, error) {
+	idStr := u.Query().Get("id")
+	if idStr == "" {
+		return 0, errors.New("missing ID parameter")
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, errors.New("person ID must be an integer")
+	}
+	return int64(id), nil
+}
+
+// fetchPersonImages returns a person and its images, or the status code and
+// error to respond with.
+func fetchPersonImages(ctx *ql.TCtx, u *url.URL, function string) (*person, []*personImage, int, error) {
+	id, err := personIDParam(u)
+	if err != nil {
+		return nil, nil, http.StatusBadRequest, err
+	}
+
+	p, err := fetchPerson(ctx, id)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+
+	if p == nil {
+		return nil, nil, http.StatusNotFound, errors.New("person not found")
+	}
+
+	imgs, err := personImages(ctx, p)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	return p, imgs, http.StatusOK, nil
+}
+
+// GET /person/{id}/images
+func getPersonImages(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*personImage, error) {
+	ctx := readCtx
+	_, imgs, status, err := fetchPersonImages(ctx, u, "getPersonImages")
+	if err != nil {
+		return status, nil, nil, err
+	}
+	return http.StatusOK, nil, imgs, nil
+}
+
+// POST /person/{id}/images
+func addPersonImage(u *url.URL, h http.Header, pi *personImage) (int, http.Header, []*personImage, error) {
+	if imageFiles.get(pi.Filename) == nil {
+		return http.StatusBadRequest, nil, nil, errors.New("image does not exist")
+	}
+
+	ctx := ql.NewRWCtx()
+	p, imgs, status, err := fetchPersonImages(ctx, u, "addPersonImage")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	for _, old := range imgs {
+		if old.Filename == pi.Filename {
+			return http.StatusBadRequest, nil, nil, errors.New("person allready has this image")
+		}
+		if pi.Primary {
+			old.Primary = false
+		}
+	}
+	imgs = append(imgs, pi)
+
+	if _, err := savePersonImages(ctx, p.ID, imgs); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "addPersonImage", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	log.Info("person image added", log.Ctx{"ID": p.ID, "Image": pi.Filename, "Primary": pi.Primary})
+	emitPersonUpdated(ctx, p.ID)
+
+	return http.StatusCreated, nil, imgs, nil
+}
+
+// PUT /person/{id}/images
+func reorderPersonImages(u *url.URL, h http.Header, order *imageOrder) (int, http.Header, []*personImage, error) {
+	ctx := ql.NewRWCtx()
+	p, imgs, status, err := fetchPersonImages(ctx, u, "reorderPersonImages")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	byName := make(map[string]*personImage)
+	for _, pi := range imgs {
+		byName[pi.Filename] = pi
+	}
+	if len(order.Order) == 0 {
+		order.Order = make([]string, 0, len(imgs))
+		for _, pi := range imgs {
+			order.Order = append(order.Order, pi.Filename)
+		}
+	}
+	if len(order.Order) != len(imgs) {
+		return http.StatusBadRequest, nil, nil, errors.New("order must list all images of the person")
+	}
+
+	reordered := make([]*personImage, 0, len(imgs))
+	for _, f := range order.Order {
+		pi, ok := byName[f]
+		if !ok {
+			return http.StatusBadRequest, nil, nil, errors.New("order must list all images of the person")
+		}
+		delete(byName, f)
+		reordered = append(reordered, pi)
+	}
+
+	if order.Primary != "" {
+		found := false
+		for _, pi := range reordered {
+			pi.Primary = pi.Filename == order.Primary
+			found = found || pi.Primary
+		}
+		if !found {
+			return http.StatusBadRequest, nil, nil, errors.New("primary image is not an image of the person")
+		}
+	}
+
+	if _, err := savePersonImages(ctx, p.ID, reordered); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "reorderPersonImages", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	log.Info("person images reordered", log.Ctx{"ID": p.ID, "Order": order.Order, "Primary": order.Primary})
+	emitPersonUpdated(ctx, p.ID)
+
+	return http.StatusOK, nil, reordered, nil
+}
+
+// DELETE /person/{id}/images/{filename}
+func removePersonImage(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+	filename := u.Query().Get("filename")
+
+	ctx := ql.NewRWCtx()
+	p, imgs, status, err := fetchPersonImages(ctx, u, "removePersonImage")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	var kept []*personImage
+	for _, pi := range imgs {
+		if pi.Filename != filename {
+			kept = append(kept, pi)
+		}
+	}
+	if len(kept) == len(imgs) {
+		return http.StatusNotFound, nil, nil, errors.New("person does not have this image")
+	}
+
+	if _, err := savePersonImages(ctx, p.ID, kept); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "removePersonImage", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	releaseImage(ctx, filename)
+
+	log.Info("person image removed", log.Ctx{"ID": p.ID, "Image": filename})
+	emitPersonUpdated(ctx, p.ID)
+
+	return http.StatusNoContent, nil, nil, nil
+}
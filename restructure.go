@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// restructureReport is the result of merging or splitting a department.
+type restructureReport struct {
+	Department  *department // the department merged into, or split off
+	Persons     []int64     // the persons moved
+	Departments []int64     // the subdepartments moved
+}
+
+// fetchDepartment returns the department with the given ID, or nil if there
+// is none.
+func fetchDepartment(ctx *ql.TCtx, id int64) (*department, error) {
+	rs, _, err := db.Execute(ctx, qGetDept, id)
+	if err != nil {
+		return nil, err
+	}
+	row, err := rs[0].FirstRow()
+	if err != nil || row == nil {
+		return nil, err
+	}
+	d := &department{}
+	if err := ql.Unmarshal(d, row); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// idRows returns the IDs given by the first column of the query.
+func idRows(ctx *ql.TCtx, q ql.List, args ...interface{}) ([]int64, error) {
+	rs, _, err := db.Execute(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	ids := []int64{}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		ids = append(ids, data[0].(int64))
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// moveMembership returns the memberships with the one in the department from
+// moved to the department to. If the person is already a member of to, the
+// membership in from is dropped instead, passing on whether it was primary.
+func moveMembership(ms []*membership, from, to int64) []*membership {
+	var existing *membership
+	for _, m := range ms {
+		if m.Dept == to {
+			existing = m
+		}
+	}
+	res := []*membership{}
+	for _, m := range ms {
+		switch {
+		case m.Dept != from:
+			res = append(res, m)
+		case existing == nil:
+			m.Dept = to
+			res = append(res, m)
+		case m.Primary:
+			existing.Primary = true
+		}
+	}
+	return res
+}
+
+// movePersons moves the given persons from one department to another. On
+// failure it returns the HTTP status code to respond with.
+func movePersons(ctx *ql.TCtx, after *afterCommit, ids []int64, from, to int64, function string) (int, error) {
+	for _, id := range ids {
+		p, err := fetchPerson(ctx, id)
+		if err == nil && p != nil {
+			err = setPersonDetails(ctx, p)
+		}
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if p == nil {
+			return http.StatusNotFound, fmt.Errorf("person %d does not exist", id)
+		}
+		p.Memberships = moveMembership(p.Memberships, from, to)
+		if status, err := changePerson(ctx, after, int(id), nil, p); err != nil {
+			return status, err
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// deptIDParam returns the department ID given by the path parameter name.
+func deptIDParam(u *url.URL, name string) (int64, error) {
+	s := u.Query().Get(name)
+	if s == "" {
+		return 0, fmt.Errorf("missing %s parameter", name)
+	}
+	id, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.New("department ID must be an integer")
+	}
+	return int64(id), nil
+}
+
+// POST /department/{id}/merge-into/{target}
+func mergeDepartment(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *restructureReport, error) {
+	id, err := deptIDParam(u, "id")
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	target, err := deptIDParam(u, "target")
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	if id == target {
+		return http.StatusBadRequest, nil, nil, errors.New("cannot merge a department into itself")
+	}
+
+	report := &restructureReport{}
+	status, err := inTransaction("mergeDepartment", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		src, err := fetchDepartment(ctx, id)
+		if err == nil && src != nil {
+			report.Department, err = fetchDepartment(ctx, target)
+		}
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "mergeDepartment", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if src == nil {
+			return http.StatusNotFound, errors.New("department does not exist")
+		}
+		if report.Department == nil {
+			return http.StatusNotFound, errors.New("target department does not exist")
+		}
+
+		// The subdepartments are moved to the target, which cannot be
+		// one of them.
+		below, err := inSubtree(ctx, target, id)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "mergeDepartment", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if below {
+			return http.StatusBadRequest, errors.New("cannot merge a department into one of its subdepartments")
+		}
+
+		if report.Persons, err = idRows(ctx, qDeptHasPersons, id); err != nil {
+			log.Error("database query failed", log.Ctx{"function": "mergeDepartment", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if status, err := movePersons(ctx, after, report.Persons, id, target, "mergeDepartment"); err != nil {
+			return status, err
+		}
+
+		if report.Departments, err = idRows(ctx, qDeptHasDept, id); err != nil {
+			log.Error("database query failed", log.Ctx{"function": "mergeDepartment", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		for _, sub := range report.Departments {
+			d, err := fetchDepartment(ctx, sub)
+			if err != nil {
+				log.Error("database query failed", log.Ctx{"function": "mergeDepartment", "error": err.Error()})
+				return http.StatusInternalServerError, errors.New("database query failed")
+			}
+			d.Parent = target
+			if _, status, err := changeDepartment(ctx, after, int(sub), nil, d); err != nil {
+				return status, err
+			}
+		}
+
+		return removeDepartment(ctx, after, int(id))
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	log.Info("department merged", log.Ctx{"ID": id, "target": target, "persons": len(report.Persons), "departments": len(report.Departments)})
+	return http.StatusOK, nil, report, nil
+}
+
+// splitRequest names the department to split off, and the persons to move
+// to it.
+type splitRequest struct {
+	Name    string
+	Persons []int64
+}
+
+// POST /department/{id}/split
+func splitDepartment(u *url.URL, h http.Header, req *splitRequest) (int, http.Header, *restructureReport, error) {
+	id, err := deptIDParam(u, "id")
+	if err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+	if len(req.Persons) == 0 {
+		return http.StatusBadRequest, nil, nil, errors.New("no persons to move to the new department")
+	}
+
+	report := &restructureReport{Persons: req.Persons, Departments: []int64{}}
+	var updated time.Time
+	status, err := inTransaction("splitDepartment", func(ctx *ql.TCtx, after *afterCommit) (int, error) {
+		src, err := fetchDepartment(ctx, id)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "splitDepartment", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		if src == nil {
+			return http.StatusNotFound, errors.New("department does not exist")
+		}
+
+		members, err := idRows(ctx, qDeptHasPersons, id)
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "splitDepartment", "error": err.Error()})
+			return http.StatusInternalServerError, errors.New("database query failed")
+		}
+		isMember := make(map[int64]bool)
+		for _, m := range members {
+			isMember[m] = true
+		}
+		for _, p := range req.Persons {
+			if !isMember[p] {
+				return http.StatusBadRequest, fmt.Errorf("person %d is not a member of the department", p)
+			}
+		}
+
+		// The new department is a sibling of the one split.
+		report.Department = &department{Name: req.Name, Parent: src.Parent}
+		var status int
+		if updated, status, err = addDepartment(ctx, after, report.Department); err != nil {
+			return status, err
+		}
+		return movePersons(ctx, after, req.Persons, id, report.Department.ID, "splitDepartment")
+	})
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	log.Info("department split", log.Ctx{"ID": id, "new": report.Department.ID, "persons": len(report.Persons)})
+	header := versionHeaders(updated)
+	header.Set("Content-Location", fmt.Sprintf("%s://%s/api/department/%d", u.Scheme, u.Host, report.Department.ID))
+	return http.StatusCreated, header, report, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3ImageStore stores images in a bucket on an S3-compatible object storage
+// service, such as Amazon S3 or MinIO. Requests use path-style addressing
+// and are signed with AWS Signature Version 4.
+type s3ImageStore struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3ImageStore(endpoint, region, bucket, prefix, accessKey, secretKey string) (*s3ImageStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("s3 image store needs an endpoint and a bucket")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3ImageStore{
+		endpoint:  u,
+		region:    region,
+		bucket:    bucket,
+		prefix:    prefix,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// s3Error is the error returned when the storage service responds with an
+// unexpected status code.
+type s3Error struct {
+	Status int
+	Code   string `xml:"Code"`
+	Msg    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Msg)
+}
+
+func newS3Error(resp *http.Response) error {
+	e := &s3Error{Status: resp.StatusCode}
+	b, _ := ioutil.ReadAll(resp.Body)
+	xml.Unmarshal(b, e)
+	return e
+}
+
+func (s *s3ImageStore) Put(name string, r io.Reader) error {
+	if !validImageName(name) {
+		return errInvalidImageName
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	req, err := s.newRequest("PUT", s.prefix+name, nil, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mime.TypeByExtension(path.Ext(name)))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newS3Error(resp)
+	}
+	return nil
+}
+
+func (s *s3ImageStore) Get(name string) (io.ReadCloser, error) {
+	if !validImageName(name) {
+		return nil, errInvalidImageName
+	}
+	req, err := s.newRequest("GET", s.prefix+name, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, errImageNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, newS3Error(resp)
+	}
+}
+
+func (s *s3ImageStore) Delete(name string) error {
+	if !validImageName(name) {
+		return errInvalidImageName
+	}
+	req, err := s.newRequest("DELETE", s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return newS3Error(resp)
+	}
+	return nil
+}
+
+// s3ListResult is the response body of a ListObjectsV2 request.
+type s3ListResult struct {
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+}
+
+func (s *s3ImageStore) List() ([]imageInfo, error) {
+	var res []imageInfo
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}}
+		if s.prefix != "" {
+			q.Set("prefix", s.prefix)
+		}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := s.newRequest("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = newS3Error(resp)
+			resp.Body.Close()
+			return nil, err
+		}
+		var lr s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&lr)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range lr.Contents {
+			name := strings.TrimPrefix(c.Key, s.prefix)
+			if !validImageName(name) {
+				continue
+			}
+			res = append(res, imageInfo{Name: name, Size: c.Size, Modified: c.LastModified})
+		}
+		if !lr.IsTruncated || lr.NextContinuationToken == "" {
+			return res, nil
+		}
+		token = lr.NextContinuationToken
+	}
+}
+
+// newRequest returns a signed request for the given object key in the
+// bucket. An empty key addresses the bucket itself.
+func (s *s3ImageStore) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, body, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds an AWS Signature Version 4 authorization header to req.
+func (s *s3ImageStore) sign(req *http.Request, body []byte, t time.Time) {
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes s as required by Signature Version 4; only
+// unreserved characters are left as is.
+func s3Escape(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3EscapePath escapes each segment of the path p.
+func s3EscapePath(p string) string {
+	segs := strings.Split(p, "/")
+	for i, seg := range segs {
+		segs[i] = s3Escape(seg)
+	}
+	return strings.Join(segs, "/")
+}
+
+// s3Query returns the canonical query string for q: keys sorted, keys and
+// values escaped.
+func s3Query(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k)+"="+s3Escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetSubjects    = ql.MustCompile(`SELECT Person, Low, High, Label FROM Subject WHERE Person == $1 ORDER BY Low ASC;`)
+	qGetAllSubjects = ql.MustCompile(`SELECT Person, Low, High, Label FROM Subject ORDER BY Low ASC;`)
+	qInsertSubject  = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Subject VALUES($1, $2, $3, $4); COMMIT;`)
+	qDeleteSubjects = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Subject WHERE Person == $1; COMMIT;`)
+
+	deweyNumbers = regexp.MustCompile(`^[0-9]{3}(\.[0-9]+)?$`)
+)
+
+// subject is a range of the Dewey Decimal Classification which a person is
+// responsible for, e.g. 900-999 History. The range includes all numbers
+// starting with High, so 900-999 includes 999.9.
+type subject struct {
+	Person int64 `json:"-"`
+	Low    string
+	High   string
+	Label  string
+}
+
+// subjectHit is a person responsible for a matching subject range.
+type subjectHit struct {
+	Subject *subject
+	Person  *person
+}
+
+// deweyFloat returns the Dewey number s as a float, truncated to the given
+// number of decimals.
+func deweyFloat(s string, decimals int) float64 {
+	if i := strings.Index(s, "."); i != -1 {
+		if len(s)-i-1 > decimals {
+			s = s[:i+1+decimals]
+		}
+	}
+	f, _ := strconv.ParseFloat(strings.TrimSuffix(s, "."), 64)
+	return f
+}
+
+// deweyDecimals returns the number of decimals in the Dewey number s.
+func deweyDecimals(s string) int {
+	if i := strings.Index(s, "."); i != -1 {
+		return len(s) - i - 1
+	}
+	return 0
+}
+
+// contains reports whether the Dewey number ddc is in the range.
+func (s *subject) contains(ddc string) bool {
+	return deweyFloat(ddc, deweyDecimals(s.Low)) >= deweyFloat(s.Low, deweyDecimals(s.Low)) &&
+		deweyFloat(ddc, deweyDecimals(s.High)) <= deweyFloat(s.High, deweyDecimals(s.High))
+}
+
+// width returns the size of the range; smaller ranges are more specific. As
+// the range includes all numbers starting with High, "947" is as wide as
+// "947-947.9", and wider than "947.5".
+func (s *subject) width() float64 {
+	high := deweyDecimals(s.High)
+	return deweyFloat(s.High, high) + math.Pow10(-high) - deweyFloat(s.Low, deweyDecimals(s.Low))
+}
+
+// prepareSubjects validates the subject ranges of a person being created or
+// updated. If Subjects is missing, the ranges of old are kept.
+func prepareSubjects(p, old *person) error {
+	if p.Subjects == nil {
+		p.Subjects = old.Subjects
+	}
+	for _, s := range p.Subjects {
+		s.Low, s.High = strings.TrimSpace(s.Low), strings.TrimSpace(s.High)
+		if s.High == "" {
+			s.High = s.Low
+		}
+		if !deweyNumbers.MatchString(s.Low) || !deweyNumbers.MatchString(s.High) {
+			return fmt.Errorf("invalid Dewey range: %s-%s", s.Low, s.High)
+		}
+		if deweyFloat(s.High, deweyDecimals(s.High)) < deweyFloat(s.Low, deweyDecimals(s.Low)) {
+			return fmt.Errorf("Dewey range cannot end before it starts: %s-%s", s.Low, s.High)
+		}
+	}
+	return nil
+}
+
+// subjectRows returns the subject ranges of the given person, or of all
+// persons.
+func subjectRows(ctx *ql.TCtx, ps ...*person) ([]*subject, error) {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetSubjects, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllSubjects)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res []*subject
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		s := &subject{}
+		if err := ql.Unmarshal(s, data); err != nil {
+			return false, err
+		}
+		res = append(res, s)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setPersonSubjects fills in the subject ranges of the given persons.
+func setPersonSubjects(ctx *ql.TCtx, ps ...*person) error {
+	ss, err := subjectRows(ctx, ps...)
+	if err != nil {
+		return err
+	}
+	byPerson := make(map[int64][]*subject)
+	for _, s := range ss {
+		byPerson[s.Person] = append(byPerson[s.Person], s)
+	}
+	for _, p := range ps {
+		p.Subjects = byPerson[p.ID]
+		if p.Subjects == nil {
+			p.Subjects = []*subject{}
+		}
+	}
+	return nil
+}
+
+// savePersonSubjects replaces the subject ranges of a person.
+func savePersonSubjects(ctx *ql.TCtx, id int64, ss []*subject) (err error) {
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeleteSubjects, id); err != nil {
+		return err
+	}
+	for _, s := range ss {
+		s.Person = id
+		if _, _, err = db.Execute(ctx, qInsertSubject, ql.MustMarshal(s)...); err != nil {
+			return err
+		}
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// subjectsIndexText returns the labels of a person's subject ranges, to be
+// searchable.
+func subjectsIndexText(p *person) string {
+	var labels []string
+	for _, s := range p.Subjects {
+		if s.Label != "" {
+			labels = append(labels, s.Label)
+		}
+	}
+	return strings.Join(labels, " ")
+}
+
+type subjectHits []subjectHit
+
+func (s subjectHits) Len() int      { return len(s) }
+func (s subjectHits) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s subjectHits) Less(i, j int) bool {
+	if wi, wj := s[i].Subject.width(), s[j].Subject.width(); wi != wj {
+		return wi < wj
+	}
+	return personKeys["name"](s[i].Person) < personKeys["name"](s[j].Person)
+}
+
+// GET /subject?ddc={number}
+//
+// getSubject returns the persons responsible for the Dewey number, the ones
+// with the most specific matching range first.
+func getSubject(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []subjectHit, error) {
+	ddc := strings.TrimSpace(u.Query().Get("ddc"))
+	if !deweyNumbers.MatchString(ddc) {
+		return http.StatusBadRequest, nil, nil, errors.New("ddc parameter must be a Dewey number, like 947.5")
+	}
+
+	ctx := readCtx
+	ss, err := subjectRows(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getSubject", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	ids := make(map[int64]bool)
+	var matching []*subject
+	for _, s := range ss {
+		if s.contains(ddc) {
+			matching = append(matching, s)
+			ids[s.Person] = true
+		}
+	}
+
+	persons, err := personsByIDs(ctx, ids)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getSubject", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if !showInternal(u) {
+		hideInternal(persons...)
+	}
+	byID := make(map[int64]*person)
+	for _, p := range persons {
+		byID[p.ID] = p
+	}
+
+	hits := subjectHits{}
+	for _, s := range matching {
+		if p, ok := byID[s.Person]; ok {
+			hits = append(hits, subjectHit{Subject: s, Person: p})
+		}
+	}
+	sort.Sort(hits)
+	return http.StatusOK, nil, hits, nil
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetAllTags       = ql.MustCompile(`SELECT id(), Name, Kind FROM Tag ORDER BY Name ASC;`)
+	qInsertTag        = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Tag VALUES($1, $2); COMMIT;`)
+	qUpdateTag        = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Tag SET Name = $1, Kind = $2 WHERE id() == $3; COMMIT;`)
+	qDeleteTag        = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Tag WHERE id() == $1; DELETE FROM PersonTag WHERE Tag == $1; COMMIT;`)
+	qGetPersonTags    = ql.MustCompile(`SELECT Person, Tag FROM PersonTag WHERE Person == $1;`)
+	qGetAllPersonTags = ql.MustCompile(`SELECT Person, Tag FROM PersonTag;`)
+	qInsertPersonTag  = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO PersonTag VALUES($1, $2); COMMIT;`)
+	qDeletePersonTags = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM PersonTag WHERE Person == $1; COMMIT;`)
+	qTaggedPersons    = ql.MustCompile(`SELECT DISTINCT Person FROM PersonTag WHERE Tag == $1;`)
+	qGetPersonsByIDs  = `SELECT id(), Name, Dept, Email, Img, Role, Info, Phone, Updated FROM Person WHERE id() IN (%s);`
+)
+
+// Kinds of tags
+const (
+	TagSkill    = "skill"
+	TagSubject  = "subject"
+	TagLanguage = "language"
+)
+
+// tag is a term in the controlled vocabulary of skills, subject areas and
+// languages which persons can be tagged with.
+type tag struct {
+	ID    int64
+	Name  string
+	Kind  string // skill, subject or language
+	Count int    `ql:"-"` // number of persons tagged; read only
+}
+
+type personTag struct {
+	Person int64
+	Tag    int64
+}
+
+// validate checks a tag, and that no other tag in tags has the same name.
+func (t *tag) validate(tags map[string]*tag) error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" || strings.ContainsAny(t.Name, "/?#") {
+		return errors.New("tag name cannot be empty or contain any of / ? #")
+	}
+	switch t.Kind {
+	case TagSkill, TagSubject, TagLanguage:
+	default:
+		return errors.New("tag kind must be one of skill, subject or language")
+	}
+	if other, ok := tags[strings.ToLower(t.Name)]; ok && other.ID != t.ID {
+		return errors.New("a tag with same name allready exists")
+	}
+	return nil
+}
+
+// allTags returns all tags, by lowercased name.
+func allTags(ctx *ql.TCtx) (map[string]*tag, error) {
+	rs, _, err := db.Execute(ctx, qGetAllTags)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]*tag)
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		t := &tag{}
+		if err := ql.Unmarshal(t, data); err != nil {
+			return false, err
+		}
+		tags[strings.ToLower(t.Name)] = t
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// personTags returns the tag references of the given person, or of all
+// persons.
+func personTags(ctx *ql.TCtx, ps ...*person) ([]personTag, error) {
+	var rs []ql.Recordset
+	var err error
+	if len(ps) == 1 {
+		rs, _, err = db.Execute(ctx, qGetPersonTags, ps[0].ID)
+	} else {
+		rs, _, err = db.Execute(ctx, qGetAllPersonTags)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var res []personTag
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		pt := personTag{}
+		if err := ql.Unmarshal(&pt, data); err != nil {
+			return false, err
+		}
+		res = append(res, pt)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setPersonTags fills in the tags of the given persons, sorted by name.
+func setPersonTags(ctx *ql.TCtx, ps ...*person) error {
+	tags, err := allTags(ctx)
+	if err != nil {
+		return err
+	}
+	names := make(map[int64]string)
+	for _, t := range tags {
+		names[t.ID] = t.Name
+	}
+
+	pts, err := personTags(ctx, ps...)
+	if err != nil {
+		return err
+	}
+	byPerson := make(map[int64][]string)
+	for _, pt := range pts {
+		if name, ok := names[pt.Tag]; ok {
+			byPerson[pt.Person] = append(byPerson[pt.Person], name)
+		}
+	}
+
+	for _, p := range ps {
+		p.Tags = byPerson[p.ID]
+		if p.Tags == nil {
+			p.Tags = []string{}
+		}
+		sort.Strings(p.Tags)
+	}
+	return nil
+}
+
+// prepareTags checks that the tags of a person being created or updated are
+// in the vocabulary, and normalizes their names. If Tags is missing, the
+// tags of old are kept. On failure it returns the HTTP status code to
+// respond with.
+func prepareTags(ctx *ql.TCtx, p, old *person, function string) (int, error) {
+	if p.Tags == nil {
+		p.Tags = old.Tags
+		return http.StatusOK, nil
+	}
+
+	tags, err := allTags(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return http.StatusInternalServerError, errors.New("database query failed")
+	}
+	seen := make(map[string]bool)
+	res := []string{}
+	for _, name := range p.Tags {
+		t, ok := tags[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return http.StatusBadRequest, fmt.Errorf("unknown tag: %s", name)
+		}
+		if !seen[t.Name] {
+			seen[t.Name] = true
+			res = append(res, t.Name)
+		}
+	}
+	sort.Strings(res)
+	p.Tags = res
+	return http.StatusOK, nil
+}
+
+// savePersonTags replaces the tags of a person.
+func savePersonTags(ctx *ql.TCtx, id int64, names []string) (err error) {
+	tags, err := allTags(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	if _, _, err = db.Execute(ctx, qDeletePersonTags, id); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if t, ok := tags[strings.ToLower(name)]; ok {
+			if _, _, err = db.Execute(ctx, qInsertPersonTag, id, t.ID); err != nil {
+				return err
+			}
+		}
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// taggedPersons returns the IDs of the persons tagged with the named tag.
+func taggedPersons(ctx *ql.TCtx, name string) (map[int64]bool, error) {
+	tags, err := allTags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	persons := make(map[int64]bool)
+	t, ok := tags[strings.ToLower(name)]
+	if !ok {
+		return persons, nil
+	}
+
+	rs, _, err := db.Execute(ctx, qTaggedPersons, t.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		persons[data[0].(int64)] = true
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return persons, nil
+}
+
+// fetchTag returns the tag named in the tag parameter, or the status code
+// and error to respond with.
+func fetchTag(ctx *ql.TCtx, u *url.URL, param, function string) (*tag, map[string]*tag, int, error) {
+	tags, err := allTags(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	t, ok := tags[strings.ToLower(u.Query().Get(param))]
+	if !ok {
+		return nil, nil, http.StatusNotFound, errors.New("tag not found")
+	}
+	return t, tags, http.StatusOK, nil
+}
+
+// GET /tags
+func getTags(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*tag, error) {
+	ctx := readCtx
+	tags, err := allTags(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getTags", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	pts, err := personTags(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getTags", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	counts := make(map[int64]int)
+	for _, pt := range pts {
+		counts[pt.Tag]++
+	}
+
+	kind := u.Query().Get("kind")
+	res := []*tag{}
+	for _, t := range tags {
+		if kind != "" && t.Kind != kind {
+			continue
+		}
+		t.Count = counts[t.ID]
+		res = append(res, t)
+	}
+	sort.Sort(tagsByName(res))
+	return http.StatusOK, nil, res, nil
+}
+
+type tagsByName []*tag
+
+func (t tagsByName) Len() int { return len(t) }
+func (t tagsByName) Less(i, j int) bool {
+	return strings.ToLower(t[i].Name) < strings.ToLower(t[j].Name)
+}
+func (t tagsByName) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+
+// POST /tags
+func createTag(u *url.URL, h http.Header, t *tag) (int, http.Header, *tag, error) {
+	ctx := ql.NewRWCtx()
+	tags, err := allTags(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "createTag", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	t.ID, t.Count = 0, 0
+	if err := t.validate(tags); err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qInsertTag, t.Name, t.Kind); err != nil {
+		log.Error("failed insert into table Tag", log.Ctx{"function": "createTag", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+	}
+	t.ID = ctx.LastInsertID
+
+	log.Info("tag created", log.Ctx{"ID": t.ID, "Name": t.Name, "Kind": t.Kind})
+
+	return http.StatusCreated, nil, t, nil
+}
+
+// PUT /tags/{tag}
+//
+// updateTag renames a tag, or changes its kind.
+func updateTag(u *url.URL, h http.Header, t *tag) (int, http.Header, *tag, error) {
+	ctx := ql.NewRWCtx()
+	old, tags, status, err := fetchTag(ctx, u, "tag", "updateTag")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	t.ID = old.ID
+	if err := t.validate(tags); err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qUpdateTag, t.Name, t.Kind, t.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateTag", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	if t.Name != old.Name {
+		reindex()
+	}
+
+	log.Info("tag updated", log.Ctx{"ID": t.ID, "OldName": old.Name, "Name": t.Name, "Kind": t.Kind})
+
+	return http.StatusOK, nil, t, nil
+}
+
+// moveTag tags the persons tagged with src with dst instead, and removes
+// src.
+func moveTag(ctx *ql.TCtx, src, dst *tag) (err error) {
+	srcPersons, err := taggedPersons(ctx, src.Name)
+	if err != nil {
+		return err
+	}
+	dstPersons, err := taggedPersons(ctx, dst.Name)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err = db.Execute(ctx, qBegin); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			db.Execute(ctx, qRollback)
+		}
+	}()
+
+	for id := range srcPersons {
+		if dstPersons[id] {
+			continue
+		}
+		if _, _, err = db.Execute(ctx, qInsertPersonTag, id, dst.ID); err != nil {
+			return err
+		}
+	}
+	if _, _, err = db.Execute(ctx, qDeleteTag, src.ID); err != nil {
+		return err
+	}
+	_, _, err = db.Execute(ctx, qCommit)
+	return err
+}
+
+// POST /tags/{tag}/merge-into/{target}
+//
+// mergeTag moves all persons tagged with tag to target, and removes tag.
+func mergeTag(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *tag, error) {
+	ctx := ql.NewRWCtx()
+	src, _, status, err := fetchTag(ctx, u, "tag", "mergeTag")
+	if err != nil {
+		return status, nil, nil, err
+	}
+	dst, _, status, err := fetchTag(ctx, u, "target", "mergeTag")
+	if err != nil {
+		return status, nil, nil, err
+	}
+	if src.ID == dst.ID {
+		return http.StatusBadRequest, nil, nil, errors.New("cannot merge a tag into itself")
+	}
+
+	if err := moveTag(ctx, src, dst); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "mergeTag", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	reindex()
+
+	log.Info("tag merged", log.Ctx{"ID": src.ID, "Name": src.Name, "Into": dst.Name})
+
+	return http.StatusOK, nil, dst, nil
+}
+
+// DELETE /tags/{tag}
+func deleteTag(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+	ctx := ql.NewRWCtx()
+	t, _, status, err := fetchTag(ctx, u, "tag", "deleteTag")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qDeleteTag, t.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "deleteTag", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	reindex()
+
+	log.Info("tag deleted", log.Ctx{"ID": t.ID, "Name": t.Name})
+
+	return http.StatusNoContent, nil, nil, nil
+}
+
+// GET /tags/{tag}/persons
+func getTagPersons(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*person, error) {
+	ctx := readCtx
+	t, _, status, err := fetchTag(ctx, u, "tag", "getTagPersons")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	ids, err := taggedPersons(ctx, t.Name)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getTagPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	persons, err := personsByIDs(ctx, ids)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getTagPersons", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if !showInternal(u) {
+		hideInternal(persons...)
+	}
+	return http.StatusOK, nil, persons, nil
+}
+
+// personsByIDs returns the given persons, with details, sorted by name in
+// Norwegian order.
+func personsByIDs(ctx *ql.TCtx, ids map[int64]bool) ([]*person, error) {
+	persons := []*person{}
+	if len(ids) == 0 {
+		return persons, nil
+	}
+
+	var list []string
+	for id := range ids {
+		list = append(list, fmt.Sprintf("%d", id))
+	}
+	rs, _, err := db.Run(ctx, fmt.Sprintf(qGetPersonsByIDs, strings.Join(list, ", ")))
+	if err != nil {
+		return nil, err
+	}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		p := &person{}
+		if err := ql.Unmarshal(p, data); err != nil {
+			return false, err
+		}
+		persons = append(persons, p)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+
+	sortByName(persons)
+
+	if err := setPersonDetails(ctx, persons...); err != nil {
+		return nil, err
+	}
+	return persons, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+// escapeText escapes a text value in a vCard or iCalendar content line.
+func escapeText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// foldLine writes a vCard or iCalendar content line, folded so that no line
+// is longer than 75 octets, as required by RFC 6350 and RFC 5545.
+func foldLine(b *bytes.Buffer, line string) {
+	width := 75
+	for len(line) > width {
+		i := width
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		b.WriteString(line[:i])
+		b.WriteString("\r\n ")
+		line = line[i:]
+		width = 74 // the leading space counts
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// splitName splits a name into given names and family name, taking the last
+// word as the family name.
+func splitName(name string) (given, family string) {
+	words := strings.Fields(name)
+	if len(words) == 0 {
+		return "", ""
+	}
+	return strings.Join(words[:len(words)-1], " "), words[len(words)-1]
+}
+
+// vcard returns the person as a vCard 3.0, with the given department name.
+func vcard(p *person, dept string) []byte {
+	var b bytes.Buffer
+	line := func(format string, args ...interface{}) {
+		foldLine(&b, fmt.Sprintf(format, args...))
+	}
+
+	given, family := splitName(p.Name)
+	line("BEGIN:VCARD")
+	line("VERSION:3.0")
+	line("N:%s;%s;;;", escapeText(family), escapeText(given))
+	line("FN:%s", escapeText(p.Name))
+	if dept != "" {
+		line("ORG:%s", escapeText(dept))
+	}
+	if p.Role != "" {
+		line("TITLE:%s", escapeText(p.Role))
+	}
+	for _, c := range p.Phones {
+		typ := "WORK,VOICE"
+		if c.Kind == "mobile" {
+			typ = "WORK,CELL"
+		}
+		if c.Preferred {
+			typ += ",PREF"
+		}
+		line("TEL;TYPE=%s:%s", typ, escapeText(c.Value))
+	}
+	for _, c := range p.Emails {
+		typ := "INTERNET,WORK"
+		if c.Preferred {
+			typ += ",PREF"
+		}
+		line("EMAIL;TYPE=%s:%s", typ, escapeText(c.Value))
+	}
+	if l := p.Location; l != nil && !l.empty() {
+		var ext []string
+		if l.Floor != "" {
+			ext = append(ext, l.Floor+". etasje")
+		}
+		if l.Room != "" {
+			ext = append(ext, "rom "+l.Room)
+		}
+		// ADR: post office box; extended address; street; locality; region; postal code; country
+		line("ADR;TYPE=WORK:;%s;%s;%s;;;", escapeText(strings.Join(ext, ", ")), escapeText(l.Building), escapeText(l.Branch))
+	}
+	if p.Info != "" {
+		line("NOTE:%s", escapeText(p.Info))
+	}
+	line("REV:%s", p.Updated.UTC().Format("20060102T150405Z"))
+	line("UID:urn:folk:person:%d", p.ID)
+	line("END:VCARD")
+	return b.Bytes()
+}
+
+// GET /person/{id}/vcard
+//
+// vcardHandler serves the person as a vCard. Internal contact points are
+// included with the parameter internal=true.
+func vcardHandler(w http.ResponseWriter, r *http.Request) {
+	idStr := r.URL.Query().Get("id")
+	if idStr == "" {
+		writeError(w, http.StatusBadRequest, errors.New("missing ID parameter"))
+		return
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("person ID must be an integer"))
+		return
+	}
+
+	ctx := readCtx
+	p, err := fetchPerson(ctx, int64(id))
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "vcardHandler", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+	if p == nil {
+		writeError(w, http.StatusNotFound, errors.New("person not found"))
+		return
+	}
+	if err := setPersonDetails(ctx, p); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "vcardHandler", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+	if !showInternal(r.URL) {
+		hideInternal(p)
+	}
+
+	depts, err := departmentNames(ctx)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "vcardHandler", "error": err.Error()})
+		writeError(w, http.StatusInternalServerError, errors.New("database query failed"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%d.vcf"`, p.ID))
+	w.Write(vcard(p, depts[p.Dept]))
+}
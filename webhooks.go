@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cznic/ql"
+	log "gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	qGetWebhook        = ql.MustCompile(`SELECT id(), URL, Secret, EventList, Paused FROM Webhook WHERE id() == $1;`)
+	qGetAllWebhooks    = ql.MustCompile(`SELECT id(), URL, Secret, EventList, Paused FROM Webhook ORDER BY id() ASC;`)
+	qInsertWebhook     = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO Webhook VALUES($1, $2, $3, $4); COMMIT;`)
+	qUpdateWebhook     = ql.MustCompile(`BEGIN TRANSACTION; UPDATE Webhook SET URL = $1, Secret = $2, EventList = $3, Paused = $4 WHERE id() == $5; COMMIT;`)
+	qDeleteWebhook     = ql.MustCompile(`BEGIN TRANSACTION; DELETE FROM Webhook WHERE id() == $1; DELETE FROM WebhookDelivery WHERE Webhook == $1; COMMIT;`)
+	qInsertDelivery    = ql.MustCompile(`BEGIN TRANSACTION; INSERT INTO WebhookDelivery VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10); COMMIT;`)
+	qUpdateDelivery    = ql.MustCompile(`BEGIN TRANSACTION; UPDATE WebhookDelivery SET Attempts = $1, NextAttempt = $2, Status = $3, LastStatus = $4, LastError = $5, Delivered = $6 WHERE id() == $7; COMMIT;`)
+	qPendingDeliveries = ql.MustCompile(`SELECT id(), Webhook, Event, Payload, Attempts, NextAttempt, Status, LastStatus, LastError, Created, Delivered FROM WebhookDelivery WHERE Status == "pending" && NextAttempt <= $1 ORDER BY NextAttempt ASC;`)
+	qWebhookDeliveries = ql.MustCompile(`SELECT id(), Webhook, Event, Payload, Attempts, NextAttempt, Status, LastStatus, LastError, Created, Delivered FROM WebhookDelivery WHERE Webhook == $1 ORDER BY id() DESC LIMIT $2;`)
+)
+
+const (
+	MaxWebhookAttempts  = 10               // attempts before a delivery is given up
+	WebhookPollInterval = 30 * time.Second // how often the delivery queue is checked
+	MaxDeliveryLog      = 100              // nr of deliveries to list in the delivery log
+)
+
+// Statuses of webhook deliveries.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+	DeliverySending   = "sending" // a test delivery being sent right away
+)
+
+// webhookEvents are the events webhooks can subscribe to. A subscription to
+// "person.*" includes all person events, and "*" all events.
+var webhookEvents = map[string]bool{
+	"person.created":     true,
+	"person.updated":     true,
+	"person.deleted":     true,
+	"department.created": true,
+	"department.updated": true,
+	"department.deleted": true,
+	"image.created":      true,
+	"image.updated":      true,
+	"image.deleted":      true,
+}
+
+var (
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+	webhookWake   = make(chan struct{}, 1) // signals that deliveries are queued
+)
+
+// webhook is an endpoint which is sent the events it subscribes to.
+type webhook struct {
+	ID        int64
+	URL       string
+	Secret    string   // key of the HMAC-SHA256 signature of payloads
+	EventList string   `json:"-"` // Events, comma separated
+	Paused    bool     // no events are sent while paused
+	Events    []string `ql:"-"` // subscribed events; all if empty
+}
+
+// delivery is an event queued for, or delivered to, a webhook.
+type delivery struct {
+	ID          int64
+	Webhook     int64
+	Event       string
+	Payload     string
+	Attempts    int64
+	NextAttempt time.Time
+	Status      string // "pending", "sending", "delivered" or "failed"
+	LastStatus  int64  // HTTP status code of the last attempt; 0 if no response
+	LastError   string
+	Created     time.Time
+	Delivered   time.Time
+}
+
+// event is the payload sent to webhooks and the event stream.
+type event struct {
+	Type string
+	Time time.Time
+	Data interface{}
+}
+
+// subscribes reports whether the webhook is to be sent the event.
+func (w *webhook) subscribes(typ string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == "*" || e == typ || (strings.HasSuffix(e, ".*") && strings.HasPrefix(typ, e[:len(e)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the webhook, and makes a secret if it has none.
+func (w *webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("webhook URL must be an absolute http or https URL")
+	}
+	for _, e := range w.Events {
+		if e == "*" || webhookEvents[e] {
+			continue
+		}
+		if strings.HasSuffix(e, ".*") && webhookEvents[strings.TrimSuffix(e, "*")+"created"] {
+			continue
+		}
+		return fmt.Errorf("unknown event: %q", e)
+	}
+	w.EventList = strings.Join(w.Events, ",")
+	if w.Secret == "" {
+		b := make([]byte, 20)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		w.Secret = hex.EncodeToString(b)
+	}
+	return nil
+}
+
+// sign returns the signature of a payload, as sent in the X-Folk-Signature
+// header.
+func sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns how long to wait before the next delivery attempt,
+// after the given number of failed attempts.
+func webhookBackoff(attempts int64) time.Duration {
+	d := 30 * time.Second
+	for i := int64(1); i < attempts && d < 6*time.Hour; i++ {
+		d *= 2
+	}
+	if d > 6*time.Hour {
+		d = 6 * time.Hour
+	}
+	return d
+}
+
+// webhookRows returns the webhooks from running q with the given arguments.
+func webhookRows(ctx *ql.TCtx, q ql.List, args ...interface{}) ([]*webhook, error) {
+	rs, _, err := db.Execute(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*webhook{}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		w := &webhook{}
+		if err := ql.Unmarshal(w, data); err != nil {
+			return false, err
+		}
+		w.Events = []string{}
+		if w.EventList != "" {
+			w.Events = strings.Split(w.EventList, ",")
+		}
+		res = append(res, w)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// deliveryRows returns the deliveries from running q with the given
+// arguments.
+func deliveryRows(ctx *ql.TCtx, q ql.List, args ...interface{}) ([]*delivery, error) {
+	rs, _, err := db.Execute(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*delivery{}
+	if err := rs[0].Do(false, func(data []interface{}) (bool, error) {
+		d := &delivery{}
+		if err := ql.Unmarshal(d, data); err != nil {
+			return false, err
+		}
+		res = append(res, d)
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// queueDelivery stores a new delivery of the event to the webhook, with the
+// given status. Only pending deliveries are picked up by deliverPending.
+func queueDelivery(ctx *ql.TCtx, w *webhook, typ string, payload []byte, status string) (*delivery, error) {
+	now := time.Now()
+	d := &delivery{Webhook: w.ID, Event: typ, Payload: string(payload), NextAttempt: now, Status: status, Created: now}
+	if _, _, err := db.Execute(ctx, qInsertDelivery, d.Webhook, d.Event, d.Payload, d.Attempts, d.NextAttempt, d.Status, d.LastStatus, d.LastError, d.Created, d.Delivered); err != nil {
+		return nil, err
+	}
+	d.ID = ctx.LastInsertID
+	return d, nil
+}
+
+// emitEvent queues the event for delivery to the webhooks subscribing to it,
+// and sends it to the clients of the event stream.
+func emitEvent(typ string, data interface{}) {
+	ev := event{Type: typ, Time: time.Now(), Data: data}
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		log.Error("failed to marshal event", log.Ctx{"event": typ, "error": err.Error()})
+		return
+	}
+	streamEvents(ev, payload)
+
+	hooks, err := webhookRows(readCtx, qGetAllWebhooks)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "emitEvent", "error": err.Error()})
+		return
+	}
+	ctx := ql.NewRWCtx()
+	queued := false
+	for _, w := range hooks {
+		if w.Paused || !w.subscribes(typ) {
+			continue
+		}
+		if _, err := queueDelivery(ctx, w, typ, payload, DeliveryPending); err != nil {
+			log.Error("failed insert into table WebhookDelivery", log.Ctx{"function": "emitEvent", "error": err.Error()})
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// emitPersonUpdated emits person.updated for the person with the given ID,
+// after a change of something belonging to the person.
+func emitPersonUpdated(ctx *ql.TCtx, id int64) {
+	p, err := fetchPerson(ctx, id)
+	if err == nil && p != nil {
+		err = setPersonDetails(ctx, p)
+	}
+	if err != nil || p == nil {
+		if err != nil {
+			log.Error("database query failed", log.Ctx{"function": "emitPersonUpdated", "error": err.Error()})
+		}
+		return
+	}
+	emitEvent("person.updated", p)
+}
+
+// attemptDelivery posts the payload of the delivery to the webhook, and
+// records the outcome. A failed delivery is retried later with backoff,
+// unless retry is false.
+func attemptDelivery(ctx *ql.TCtx, w *webhook, d *delivery, retry bool) error {
+	d.Attempts++
+	d.LastStatus, d.LastError = 0, ""
+
+	req, err := http.NewRequest("POST", w.URL, bytes.NewReader([]byte(d.Payload)))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json; charset=utf-8")
+		req.Header.Set("User-Agent", "folk-webhook")
+		req.Header.Set("X-Folk-Event", d.Event)
+		req.Header.Set("X-Folk-Delivery", strconv.FormatInt(d.ID, 10))
+		req.Header.Set("X-Folk-Signature", sign(w.Secret, []byte(d.Payload)))
+
+		var resp *http.Response
+		if resp, err = webhookClient.Do(req); err == nil {
+			resp.Body.Close()
+			d.LastStatus = int64(resp.StatusCode)
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				err = fmt.Errorf("webhook responded with %s", resp.Status)
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+		d.Status = DeliveryDelivered
+		d.Delivered = time.Now()
+	case retry && d.Attempts < MaxWebhookAttempts:
+		d.LastError = err.Error()
+		d.NextAttempt = time.Now().Add(webhookBackoff(d.Attempts))
+	default:
+		d.LastError = err.Error()
+		d.Status = DeliveryFailed
+	}
+	if err != nil {
+		log.Warn("webhook delivery failed", log.Ctx{"webhook": w.ID, "delivery": d.ID, "event": d.Event, "attempts": d.Attempts, "error": err.Error()})
+	}
+
+	_, _, dbErr := db.Execute(ctx, qUpdateDelivery, d.Attempts, d.NextAttempt, d.Status, d.LastStatus, d.LastError, d.Delivered, d.ID)
+	return dbErr
+}
+
+// deliverPending attempts the deliveries which are due.
+func deliverPending() error {
+	ctx := ql.NewRWCtx()
+	ds, err := deliveryRows(ctx, qPendingDeliveries, time.Now())
+	if err != nil {
+		return err
+	}
+
+	hooks := make(map[int64]*webhook)
+	for _, d := range ds {
+		w, ok := hooks[d.Webhook]
+		if !ok {
+			ws, err := webhookRows(ctx, qGetWebhook, d.Webhook)
+			if err != nil {
+				return err
+			}
+			if len(ws) > 0 {
+				w = ws[0]
+			}
+			hooks[d.Webhook] = w
+		}
+		if w == nil || w.Paused {
+			// Not to be delivered anymore
+			d.Status, d.LastError = DeliveryFailed, "webhook is paused"
+			if _, _, err := db.Execute(ctx, qUpdateDelivery, d.Attempts, d.NextAttempt, d.Status, d.LastStatus, d.LastError, d.Delivered, d.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := attemptDelivery(ctx, w, d, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliverWebhooks delivers queued events to webhooks, as they are queued and
+// when retries are due.
+func deliverWebhooks() {
+	for {
+		if err := deliverPending(); err != nil {
+			log.Error("failed to deliver webhooks", log.Ctx{"error": err.Error()})
+		}
+		select {
+		case <-webhookWake:
+		case <-time.After(WebhookPollInterval):
+		}
+	}
+}
+
+// fetchWebhook returns the webhook with the ID given in the id parameter, or
+// the status code and error to respond with.
+func fetchWebhook(ctx *ql.TCtx, u *url.URL, function string) (*webhook, int, error) {
+	id, err := strconv.Atoi(u.Query().Get("id"))
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("webhook ID must be an integer")
+	}
+	ws, err := webhookRows(ctx, qGetWebhook, int64(id))
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": function, "error": err.Error()})
+		return nil, http.StatusInternalServerError, errors.New("database query failed")
+	}
+	if len(ws) == 0 {
+		return nil, http.StatusNotFound, errors.New("webhook not found")
+	}
+	return ws[0], http.StatusOK, nil
+}
+
+// GET /webhook
+func getWebhooks(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*webhook, error) {
+	ws, err := webhookRows(readCtx, qGetAllWebhooks)
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getWebhooks", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	return http.StatusOK, nil, ws, nil
+}
+
+// POST /webhook
+func createWebhook(u *url.URL, h http.Header, w *webhook) (int, http.Header, *webhook, error) {
+	if err := w.validate(); err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+
+	ctx := ql.NewRWCtx()
+	if _, _, err := db.Execute(ctx, qInsertWebhook, w.URL, w.Secret, w.EventList, w.Paused); err != nil {
+		log.Error("failed insert into table Webhook", log.Ctx{"function": "createWebhook", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+	}
+	w.ID = ctx.LastInsertID
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+
+	log.Info("webhook created", log.Ctx{"ID": w.ID, "URL": w.URL, "Events": w.EventList})
+
+	return http.StatusCreated, http.Header{
+		"Content-Location": {fmt.Sprintf(
+			"%s://%s/api/webhook/%d",
+			u.Scheme,
+			u.Host,
+			w.ID,
+		)},
+	}, w, nil
+}
+
+// PUT /webhook/{id}
+func updateWebhook(u *url.URL, h http.Header, w *webhook) (int, http.Header, *webhook, error) {
+	ctx := ql.NewRWCtx()
+	old, status, err := fetchWebhook(ctx, u, "updateWebhook")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	w.ID = old.ID
+	if w.Secret == "" {
+		w.Secret = old.Secret
+	}
+	if err := w.validate(); err != nil {
+		return http.StatusBadRequest, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qUpdateWebhook, w.URL, w.Secret, w.EventList, w.Paused, w.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "updateWebhook", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	if w.Events == nil {
+		w.Events = []string{}
+	}
+
+	log.Info("webhook updated", log.Ctx{"ID": w.ID, "URL": w.URL, "Events": w.EventList, "Paused": w.Paused})
+
+	return http.StatusOK, nil, w, nil
+}
+
+// DELETE /webhook/{id}
+func deleteWebhook(u *url.URL, h http.Header, _ interface{}) (int, http.Header, interface{}, error) {
+	ctx := ql.NewRWCtx()
+	w, status, err := fetchWebhook(ctx, u, "deleteWebhook")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	if _, _, err := db.Execute(ctx, qDeleteWebhook, w.ID); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "deleteWebhook", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+
+	log.Info("webhook deleted", log.Ctx{"ID": w.ID})
+
+	return http.StatusNoContent, nil, nil, nil
+}
+
+// GET /webhook/{id}/deliveries
+//
+// getDeliveries returns the log of the most recent deliveries to the
+// webhook, the newest first.
+func getDeliveries(u *url.URL, h http.Header, _ interface{}) (int, http.Header, []*delivery, error) {
+	ctx := readCtx
+	w, status, err := fetchWebhook(ctx, u, "getDeliveries")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	ds, err := deliveryRows(ctx, qWebhookDeliveries, w.ID, int64(MaxDeliveryLog))
+	if err != nil {
+		log.Error("database query failed", log.Ctx{"function": "getDeliveries", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	return http.StatusOK, nil, ds, nil
+}
+
+// POST /webhook/{id}/test
+//
+// testWebhook sends a ping event to the webhook right away, and returns the
+// outcome. Failed test deliveries are not retried.
+func testWebhook(u *url.URL, h http.Header, _ interface{}) (int, http.Header, *delivery, error) {
+	ctx := ql.NewRWCtx()
+	w, status, err := fetchWebhook(ctx, u, "testWebhook")
+	if err != nil {
+		return status, nil, nil, err
+	}
+
+	payload, _ := json.Marshal(event{Type: "ping", Time: time.Now(), Data: map[string]int64{"Webhook": w.ID}})
+	// The ping is stored as being sent, not pending, so that deliverPending
+	// does not send it a second time.
+	d, err := queueDelivery(ctx, w, "ping", payload, DeliverySending)
+	if err != nil {
+		log.Error("failed insert into table WebhookDelivery", log.Ctx{"function": "testWebhook", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database insert failed")
+	}
+	if err := attemptDelivery(ctx, w, d, false); err != nil {
+		log.Error("database query failed", log.Ctx{"function": "testWebhook", "error": err.Error()})
+		return http.StatusInternalServerError, nil, nil, errors.New("database query failed")
+	}
+	return http.StatusOK, nil, d, nil
+}